@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+
+// Like SSH_AUTH_SOCK for ssh-agent
+const agentSocketEnv = "SIMPLECA_AGENT_SOCK"
+
+const defaultAgentLifetime = time.Hour
+
+// How long to wait for the agent before giving up (it may be stopping)
+const agentTimeout = 5 * time.Second
+
+
+func getHelpAgent() string {
+	return `Usage: simpleca agent [--lifetime=<duration>] [--socket=<path>] [--foreground]
+       simpleca agent add <class> [--name=<name>] [--lifetime=<duration>]
+       simpleca agent remove <class> [--name=<name>]
+       simpleca agent remove --all
+       simpleca agent list
+       simpleca agent stop
+
+Keep decrypted CA keys in memory so their passphrase is asked only once (like ssh-agent does for SSH keys).
+
+Without sub-command, start the agent in the background and print the shell commands setting the ` + agentSocketEnv + `
+environment variable (use it with: eval $(simpleca agent)). The keys never leave the agent: "sign" asks the agent to
+sign with them whenever it holds the key of the CA given with --with.
+
+--lifetime duration
+	(optional) How long keys are kept (e.g. "30m", "8h"). Defaults to 1 hour. When given to "agent add", overrides the
+	lifetime of the agent for this key.
+
+--socket string
+	(optional) The path of the Unix socket to listen on. Defaults to a new socket in a temporary folder.
+
+--foreground
+	(optional) Do not go to the background.
+
+Sub-commands:
+	add      unlock a key of the repository and add it to the agent
+	remove   remove a key (or all keys with --all) from the agent
+	list     list the keys held by the agent
+	stop     stop the agent
+
+` + getHelpPassphrase("", "the added key") + `
+
+` + getHelpAskpass()
+}
+
+
+// The key fingerprint, used to identify keys in the agent
+func getFingerprint(pubKey interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+
+	var sum [sha256.Size]byte = sha256.Sum256(der)
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+
+// RPC service of the agent
+type Agent struct {
+	lock sync.Mutex
+	keys map[string]*agentKey
+	lifetime time.Duration
+	stop chan bool
+}
+
+type agentKey struct {
+	name string
+	signer crypto.Signer
+	expiresOn time.Time
+	timer *time.Timer
+}
+
+type AgentAddArgs struct {
+	Name string
+	// PKCS#8 DER encoded private key
+	Key []byte
+	Lifetime time.Duration
+}
+
+type AgentKey struct {
+	Name string
+	Fingerprint string
+	ExpiresOn time.Time
+}
+
+type AgentSignArgs struct {
+	Fingerprint string
+	Digest []byte
+	Hash crypto.Hash
+}
+
+
+func (a *Agent) Add(args AgentAddArgs, reply *AgentKey) error {
+	privKey, err := x509.ParsePKCS8PrivateKey(args.Key)
+	if err != nil {
+		return err
+	}
+
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported key")
+	}
+
+	fingerprint, err := getFingerprint(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	var lifetime time.Duration = args.Lifetime
+	if lifetime <= 0 {
+		lifetime = a.lifetime
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.removeLocked(fingerprint)
+
+	a.keys[fingerprint] = &agentKey{
+		name: args.Name,
+		signer: signer,
+		expiresOn: time.Now().Add(lifetime),
+		timer: time.AfterFunc(lifetime, func() {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			a.removeLocked(fingerprint)
+		}),
+	}
+
+	*reply = AgentKey{Name: args.Name, Fingerprint: fingerprint, ExpiresOn: a.keys[fingerprint].expiresOn}
+
+	return nil
+}
+
+
+func (a *Agent) removeLocked(fingerprint string) bool {
+	key, ok := a.keys[fingerprint]
+	if ok {
+		key.timer.Stop()
+		delete(a.keys, fingerprint)
+	}
+
+	return ok
+}
+
+
+// Remove the key with the given fingerprint, or all keys if the fingerprint is empty
+func (a *Agent) Remove(fingerprint string, removed *int) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	*removed = 0
+
+	for keyFingerprint := range a.keys {
+		if fingerprint == "" || fingerprint == keyFingerprint {
+			a.removeLocked(keyFingerprint)
+			*removed++
+		}
+	}
+
+	return nil
+}
+
+
+func (a *Agent) List(_ bool, keys *[]AgentKey) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	*keys = []AgentKey{}
+
+	for fingerprint, key := range a.keys {
+		*keys = append(*keys, AgentKey{Name: key.name, Fingerprint: fingerprint, ExpiresOn: key.expiresOn})
+	}
+
+	sort.Slice(*keys, func(i, j int) bool {
+		return (*keys)[i].Name < (*keys)[j].Name
+	})
+
+	return nil
+}
+
+
+func (a *Agent) Sign(args AgentSignArgs, signature *[]byte) error {
+	a.lock.Lock()
+	key, ok := a.keys[args.Fingerprint]
+	a.lock.Unlock()
+
+	if !ok {
+		return errors.New("the agent does not hold the key " + args.Fingerprint)
+	}
+
+	result, err := key.signer.Sign(rand.Reader, args.Digest, args.Hash)
+	if err != nil {
+		return err
+	}
+
+	*signature = result
+
+	return nil
+}
+
+
+func (a *Agent) Stop(_ bool, _ *bool) error {
+	// The agent may already be stopping
+	select {
+	case a.stop <- true:
+	default:
+	}
+
+	return nil
+}
+
+
+// A crypto.Signer whose private key is held by the agent
+type agentSigner struct {
+	client *rpc.Client
+	fingerprint string
+	pubKey crypto.PublicKey
+}
+
+
+func (s *agentSigner) Public() crypto.PublicKey {
+	return s.pubKey
+}
+
+
+func (s *agentSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var signature []byte
+
+	err := callAgent(s.client, "Agent.Sign", AgentSignArgs{Fingerprint: s.fingerprint, Digest: digest, Hash: opts.HashFunc()}, &signature)
+
+	return signature, err
+}
+
+
+// Close the connection to the agent of signers using it, once they are not needed anymore
+func closeSigner(signer crypto.Signer) {
+	if s, ok := signer.(*agentSigner); ok {
+		s.client.Close()
+	}
+}
+
+
+// Call the agent, failing if it does not answer in time
+func callAgent(client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	select {
+	case call := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		return call.Error
+	case <-time.After(agentTimeout):
+		return errors.New("the agent does not answer")
+	}
+}
+
+
+// Connect to the running agent, if any
+func dialAgent() (*rpc.Client, error) {
+	var socket string = os.Getenv(agentSocketEnv)
+
+	if socket == "" {
+		return nil, errors.New("no agent is running (" + agentSocketEnv + " is not set)")
+	}
+
+	conn, err := net.DialTimeout("unix", socket, agentTimeout)
+	if err != nil {
+		return nil, errors.New("can't connect to the agent: " + err.Error())
+	}
+
+	return rpc.NewClient(conn), nil
+}
+
+
+// Return a signer using the agent if it holds the key of the element, nil otherwise
+func loadAgentSigner(el *Element) crypto.Signer {
+	if os.Getenv(agentSocketEnv) == "" {
+		return nil
+	}
+
+	pubKey, err := loadPubKey((*el).Path)
+	if err != nil {
+		return nil
+	}
+
+	fingerprint, err := getFingerprint(pubKey)
+	if err != nil {
+		return nil
+	}
+
+	client, err := dialAgent()
+	if err != nil {
+		fmt.Println("Warning: " + err.Error())
+		return nil
+	}
+
+	var keys []AgentKey
+
+	err = callAgent(client, "Agent.List", true, &keys)
+	if err != nil {
+		fmt.Println("Warning: " + err.Error())
+		client.Close()
+		return nil
+	}
+
+	for _, key := range keys {
+		if key.Fingerprint == fingerprint {
+			return &agentSigner{client: client, fingerprint: fingerprint, pubKey: pubKey}
+		}
+	}
+
+	client.Close()
+
+	return nil
+}
+
+
+// Start the agent, list its keys or stop it (the sub-commands not needing a repository)
+func agent(args []string) (string, error) {
+	var err error
+
+	if len(args) > 0 && (args[0] == "list" || args[0] == "stop") {
+		client, err := dialAgent()
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+
+		if args[0] == "stop" {
+			err = callAgent(client, "Agent.Stop", true, new(bool))
+			if err != nil {
+				return "", err
+			}
+
+			return "Agent stopped", nil
+		}
+
+		var keys []AgentKey
+
+		err = callAgent(client, "Agent.List", true, &keys)
+		if err != nil {
+			return "", err
+		}
+
+		if len(keys) == 0 {
+			return "The agent has no keys", nil
+		}
+
+		var lines []string
+		for _, key := range keys {
+			lines = append(lines, key.Fingerprint + " " + key.Name + " (expires in " + time.Until(key.ExpiresOn).Round(time.Second).String() + ")")
+		}
+
+		return strings.Join(lines, "\n"), nil
+	}
+
+	var lifetime time.Duration
+	var socket string
+	var foreground bool
+
+	commands := flag.NewFlagSet("agent", flag.ExitOnError)
+
+	commands.DurationVar(&lifetime, "lifetime", defaultAgentLifetime, "")
+	commands.StringVar(&socket, "socket", "", "")
+	commands.BoolVar(&foreground, "foreground", false, "")
+
+	commands.Parse(args)
+
+	if commands.NArg() > 0 {
+		return "", errors.New("unknown agent sub-command " + commands.Arg(0) + "\n\n" + getHelpAgent())
+	}
+
+	if socket == "" {
+		dir, err := ioutil.TempDir("", "simpleca-agent-")
+		if err != nil {
+			return "", err
+		}
+
+		socket = filepath.Join(dir, "agent.sock")
+	}
+
+	socket, err = filepath.Abs(socket)
+	if err != nil {
+		return "", err
+	}
+
+	if foreground {
+		return "", runAgent(socket, lifetime)
+	}
+
+	// Start the agent in its own session, and wait for it to listen
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command(executable, "agent", "--foreground", "--socket", socket, "--lifetime", lifetime.String())
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+
+			return agentSocketEnv + "=" + socket + "; export " + agentSocketEnv + ";\necho Agent pid " + strconv.Itoa(cmd.Process.Pid) + ";", nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return "", errors.New("the agent did not start")
+}
+
+
+func runAgent(socket string, lifetime time.Duration) error {
+	// Only the current user can talk to the agent
+	syscall.Umask(0077)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+
+	// Remove the temporary folder created for the socket as well
+	if strings.HasPrefix(filepath.Base(filepath.Dir(socket)), "simpleca-agent-") {
+		defer os.Remove(filepath.Dir(socket))
+	}
+
+	var service *Agent = &Agent{keys: make(map[string]*agentKey), lifetime: lifetime, stop: make(chan bool, 1)}
+
+	server := rpc.NewServer()
+
+	err = server.Register(service)
+	if err != nil {
+		return err
+	}
+
+	go server.Accept(listener)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	select {
+	case <-service.stop:
+	case <-signals:
+	}
+
+	listener.Close()
+
+	return nil
+}
+
+
+// Add a key of the repository to the agent, or remove it
+func agentKeys(state *State, action, class, keyName string, all bool, lifetime time.Duration, pass *passphraseSource) (string, error) {
+	if action == "remove" && all {
+		client, err := dialAgent()
+		if err != nil {
+			return "", err
+		}
+		defer client.Close()
+
+		var removed int
+
+		err = callAgent(client, "Agent.Remove", "", &removed)
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.Itoa(removed) + " keys removed from the agent", nil
+	}
+
+	switch class {
+	case "root":
+		keyName = "root"
+	case "intermediate":
+		if keyName == "" {
+			keyName = "intermediate"
+		}
+	case "client":
+		if keyName == "" {
+			keyName = "client"
+		}
+	default:
+		return "", errors.New("missing class\n\n" + getHelpAgent())
+	}
+
+	keyInState, ok := (*state).get(class, keyName)
+	if !ok {
+		return "", errors.New("key " + keyName + " is not known")
+	}
+
+	if (*keyInState).PKCS11 != "" {
+		return "", errors.New("the key of " + keyName + " is on a PKCS#11 token, it can't be added to the agent")
+	}
+
+	client, err := dialAgent()
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	if action == "remove" {
+		pubKey, err := loadPubKey((*keyInState).Path)
+		if err != nil {
+			return "", err
+		}
+
+		fingerprint, err := getFingerprint(pubKey)
+		if err != nil {
+			return "", err
+		}
+
+		var removed int
+
+		err = callAgent(client, "Agent.Remove", fingerprint, &removed)
+		if err != nil {
+			return "", err
+		}
+		if removed == 0 {
+			return "", errors.New("the agent does not hold the key of " + keyName)
+		}
+
+		return keyName + " key removed from the agent", nil
+	}
+
+	privKey, _, err := loadPrivKey((*keyInState).Type, (*keyInState).Path, pass)
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return "", err
+	}
+
+	var added AgentKey
+
+	err = callAgent(client, "Agent.Add", AgentAddArgs{Name: class + " " + keyName, Key: der, Lifetime: lifetime}, &added)
+	if err != nil {
+		return "", err
+	}
+
+	return keyName + " key added to the agent (" + added.Fingerprint + "), it expires in " + time.Until(added.ExpiresOn).Round(time.Second).String(), nil
+}
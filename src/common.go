@@ -1,17 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"crypto"
 	"crypto/rsa"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
 )
 
 const RootPath = "root"
@@ -25,6 +28,8 @@ func getPubKey(priv interface{}) interface{} {
 		return &k.PublicKey
 	case *ecdsa.PrivateKey:
 		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
 	default:
 		return nil
 	}
@@ -48,6 +53,16 @@ func getPath(keyClass, keyName string) string {
 }
 
 
+// Names become file names in the repository: they can't point to another folder
+func checkName(keyName string) error {
+	if keyName == "" || keyName == "." || keyName == ".." || strings.ContainsAny(keyName, "/\\") || filepath.Base(keyName) != keyName {
+		return errors.New("invalid name \"" + keyName + "\", it can't be empty, . or .., nor contain / or \\")
+	}
+
+	return nil
+}
+
+
 func getPrivKeyPath(path string) string {
 	return path + ".key"
 }
@@ -57,67 +72,312 @@ func getPubKeyPath(path string) string {
 func getCertPath(path string) string {
 	return path + ".crt"
 }
+// CA certificates are also written in DER, the format AIA caIssuers URLs must serve (RFC 5280 section 4.2.2.1)
+func getCertDerPath(path string) string {
+	return path + ".cer"
+}
 func getFullCertPath(path string) string {
 	return path + ".crt.fullchain"
 }
+func getCSRPath(path string) string {
+	return path + ".csr"
+}
+func getCRLPath(path string) string {
+	return path + ".crl"
+}
+func getCRLPemPath(path string) string {
+	return path + ".crl.pem"
+}
+func getDeltaCRLPath(path string) string {
+	return path + "-delta.crl"
+}
+func getDeltaCRLPemPath(path string) string {
+	return path + "-delta.crl.pem"
+}
+
+
+// Parse a serial number written in hexadecimal (as OpenSSL does)
+func newSerialFromHex(value string) (*big.Int, bool) {
+	return new(big.Int).SetString(value, 16)
+}
 
 
 // Load private key file and return both private and public keys
-func loadPrivKey(keyType, path string) (interface{}, interface{}, error) {
-	var err error
+func loadPrivKey(keyType, path string, pass *passphraseSource) (interface{}, interface{}, error) {
+	privKey, _, err := unlockPrivKey(keyType, path, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return privKey, getPubKey(privKey), nil
+}
 
-	var privKeyBytes []byte
-	var privKeyPem *pem.Block
-	var privKeyDecryptedBytes []byte
-	var privKey, pubKey interface{}
 
+// Read the private key PEM block from disk, without decrypting it
+func readPrivKey(path string) (*pem.Block, error) {
 	var privKeyPath string = getPrivKeyPath(path)
 
-	if _, err = os.Stat(privKeyPath); os.IsNotExist(err) {
-		return privKey, pubKey, errors.New("the private key " + privKeyPath + " does not exist")
+	if _, err := os.Stat(privKeyPath); os.IsNotExist(err) {
+		return nil, errors.New("the private key " + privKeyPath + " does not exist")
 	}
 
-	// Read file, decode it as PEM and load it
-	privKeyBytes, err = ioutil.ReadFile(privKeyPath)
+	privKeyBytes, err := ioutil.ReadFile(privKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyPem, _ := pem.Decode(privKeyBytes)
+	if privKeyPem == nil {
+		return nil, errors.New("the file " + privKeyPath + " does not contain a PEM encoded private key")
+	}
+
+	return privKeyPem, nil
+}
+
+
+// Load and decrypt (asking for the password if needed) the private key, return it along with the password used to
+// unlock it (empty if the key is stored in clear text)
+func unlockPrivKey(keyType, path string, pass *passphraseSource) (privKey interface{}, password string, err error) {
+	var privKeyPem *pem.Block
+
+	privKeyPem, err = readPrivKey(path)
 	if err != nil {
-		return privKey, pubKey, err
+		return nil, "", err
 	}
-	privKeyPem, _ = pem.Decode(privKeyBytes)
 
-	if x509.IsEncryptedPEMBlock(privKeyPem) {
-		var password string
+	return decryptPrivKey(keyType, privKeyPem, getPrivKeyPath(path), pass)
+}
 
-		password, err = getpass("The file " + privKeyPath + " is encrypted, please enter the password to unlock it: ")
+
+// Decrypt (asking for the password if needed) and parse the private key PEM block read from privKeyPath. If keyType is
+// empty, the type of the key is detected.
+func decryptPrivKey(keyType string, privKeyPem *pem.Block, privKeyPath string, pass *passphraseSource) (privKey interface{}, password string, err error) {
+	var privKeyDecryptedBytes []byte
+
+	if privKeyPem.Type == EncryptedPrivKeyHeader || x509.IsEncryptedPEMBlock(privKeyPem) {
+		password, err = pass.read("The file " + privKeyPath + " is encrypted, please enter the password to unlock it: ")
 		if err != nil {
-			return privKey, pubKey, err
+			return nil, "", err
 		}
+	}
 
+	switch {
+	case privKeyPem.Type == EncryptedPrivKeyHeader:
+		privKeyDecryptedBytes, err = decryptPKCS8(privKeyPem, []byte(password))
+	case x509.IsEncryptedPEMBlock(privKeyPem):
+		// Legacy OpenSSL encryption, only kept to read keys generated by old simpleca versions
 		privKeyDecryptedBytes, err = x509.DecryptPEMBlock(privKeyPem, []byte(password))
-		if err != nil {
-			return privKey, pubKey, err
-		}
-	} else {
+	default:
 		privKeyDecryptedBytes = privKeyPem.Bytes
 	}
+	if err != nil {
+		return nil, "", err
+	}
 
-	switch keyType {
-	case "rsa":
-		privKey, err = x509.ParsePKCS1PrivateKey(privKeyDecryptedBytes)
-		if err != nil {
-			return privKey, pubKey, err
+	privKey, err = parsePrivKey(keyType, privKeyDecryptedBytes)
+	if err != nil {
+		return nil, "", errors.New("can't load " + privKeyPath + ": " + err.Error())
+	}
+
+	return privKey, password, nil
+}
+
+
+// Parse a DER encoded private key, either in PKCS#8 or in the key type specific format (PKCS#1 or SEC 1). If keyType is
+// empty, all formats are tried.
+func parsePrivKey(keyType string, der []byte) (interface{}, error) {
+	var privKey interface{}
+	var err error
+
+	privKey, err = x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		switch keyType {
+		case "rsa":
+			privKey, err = x509.ParsePKCS1PrivateKey(der)
+		case "ecdsa":
+			privKey, err = x509.ParseECPrivateKey(der)
+		case "ed25519":
+			// Ed25519 keys are only stored as PKCS#8
+		case "":
+			if privKey, err = x509.ParsePKCS1PrivateKey(der); err != nil {
+				privKey, err = x509.ParseECPrivateKey(der)
+			}
+			if err != nil {
+				return nil, errors.New("unknown private key format")
+			}
+		default:
+			return nil, errors.New("key type " + keyType + " is not implemented")
 		}
-	case "ecdsa":
-		privKey, err = x509.ParseECPrivateKey(privKeyDecryptedBytes)
 		if err != nil {
-		return privKey, pubKey, err
+			return nil, err
+		}
+	}
+
+	if keyType == "" {
+		if getKeyType(privKey) == "" {
+			return nil, errors.New("unsupported private key type")
 		}
+	} else if getKeyType(privKey) != keyType {
+		return nil, errors.New("the private key is not a " + keyType + " key")
+	}
+
+	return privKey, nil
+}
+
+
+// Return the size in bits of the given public key
+func getKeySize(pubKey interface{}) int {
+	switch k := pubKey.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		return 256
 	default:
-		return privKey, pubKey, errors.New("key type " + keyType + " is not implemented")
+		return 0
 	}
+}
+
 
-	pubKey = getPubKey(privKey)
+// Marshal the public key in the PEM format used for .pub files
+func encodePubKey(pubKey interface{}) (*pem.Block, error) {
+	der, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
 
-	return privKey, pubKey, nil
+	switch getKeyType(pubKey) {
+	case RSA:
+		return &pem.Block{Type: "RSA PUBLIC KEY", Bytes: der}, nil
+	case ECDSA:
+		return &pem.Block{Type: "EC PUBLIC KEY", Bytes: der}, nil
+	default:
+		return &pem.Block{Type: "PUBLIC KEY", Bytes: der}, nil
+	}
+}
+
+
+// Return the simpleca key type of the given private or public key
+func getKeyType(key interface{}) string {
+	switch key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return RSA
+	case *ecdsa.PrivateKey, *ecdsa.PublicKey:
+		return ECDSA
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return ED25519
+	default:
+		return ""
+	}
+}
+
+
+// Encode the private key in a PEM block, encrypted with the given password unless clearText is set
+func encodePrivKey(privKey interface{}, password string, clearText bool) (*pem.Block, error) {
+	if clearText {
+		switch k := privKey.(type) {
+		case *rsa.PrivateKey:
+			return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+		case *ecdsa.PrivateKey:
+			der, err := x509.MarshalECPrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+		}
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if clearText {
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+
+	return encryptPKCS8(der, []byte(password))
+}
+
+
+// Write the file in a temporary file then rename it, so a crash never leaves a truncated file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(data)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpFile.Name(), perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+
+// Load the public key file
+func loadPubKey(path string) (interface{}, error) {
+	var pubKeyPath string = getPubKeyPath(path)
+
+	if _, err := os.Stat(pubKeyPath); os.IsNotExist(err) {
+		return nil, errors.New("the public key " + pubKeyPath + " does not exist")
+	}
+
+	pubKeyBytes, err := ioutil.ReadFile(pubKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyPem, _ := pem.Decode(pubKeyBytes)
+	if pubKeyPem == nil {
+		return nil, errors.New("the file " + pubKeyPath + " does not contain a PEM encoded public key")
+	}
+
+	return x509.ParsePKIXPublicKey(pubKeyPem.Bytes)
+}
+
+
+// Return the signer of the element, whether its private key is on a PKCS#11 token, held by the agent or on disk
+func loadSigner(el *Element, pass *passphraseSource) (crypto.Signer, error) {
+	if (*el).PKCS11 != "" {
+		return loadPKCS11Signer(el, pass)
+	}
+
+	if signer := loadAgentSigner(el); signer != nil {
+		return signer, nil
+	}
+
+	if (*el).Threshold > 0 {
+		if _, err := os.Stat(getPrivKeyPath((*el).Path)); os.IsNotExist(err) {
+			return nil, errors.New("the private key of " + (*el).Path + " has been split, give " + strconv.Itoa((*el).Threshold) + " of its shares with --share")
+		}
+	}
+
+	privKey, _, err := loadPrivKey((*el).Type, (*el).Path, pass)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("the private key of " + (*el).Path + " can't be used to sign")
+	}
+
+	return signer, nil
 }
 
 
@@ -148,51 +408,30 @@ func loadCertificate(path string) (certificatePem *pem.Block, certificateX509 *x
 }
 
 
-// Thank you go for not providing a getpass() equivalent in the stdlib
-func getpass(prompt string) (string, error) {
+// Ask for a new password twice, until both match (or read it once from a non interactive source)
+func askNewPassword(privKeyPath string, pass *passphraseSource) (string, error) {
 	var err error
-	var ws syscall.WaitStatus
-
-	// Print the prompt if needed
-	if prompt != "" {
-		fmt.Print(prompt)
-	}
+	var password string
+	var passwordCheck string = "different"
 
-	attrs := syscall.ProcAttr{
-		Dir: "",
-		Env: []string{},
-		Files: []uintptr{os.Stdin.Fd()},
-		Sys: nil,
+	if !pass.isInteractive() {
+		return pass.read("")
 	}
 
-	pid, err := syscall.ForkExec("/bin/stty", []string{"stty", "-echo"}, &attrs)
-	if err != nil {
-		return "", err
-	}
-
-	_, err = syscall.Wait4(pid, &ws, 0, nil)
-	if err != nil {
-		return "", err
-	}
-
-	reader := bufio.NewReader(os.Stdin)
-	text, err := reader.ReadString('\n')
-	if err != nil {
-		return "", err
-	}
-
-	pid, err = syscall.ForkExec("/bin/stty", []string{"stty", "echo"}, &attrs)
-	if err != nil {
-		return "", err
-	}
+	for password != passwordCheck {
+		password, err = getpass("Please provide the password for the file " + privKeyPath + ": ")
+		if err != nil {
+			return "", err
+		}
+		passwordCheck, err = getpass("Please repeat it: ")
+		if err != nil {
+			return "", err
+		}
 
-	_, err = syscall.Wait4(pid, &ws, 0, nil)
-	if err != nil {
-		return "", err
+		if password != passwordCheck {
+			fmt.Println("Passwords don't match")
+		}
 	}
 
-	// Print the carriage return that has been swallowed
-	fmt.Println()
-
-	return strings.TrimSpace(text), nil
+	return password, nil
 }
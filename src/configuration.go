@@ -10,10 +10,26 @@ const confPath = "configuration.json"
 
 
 type Conf struct {
-	CertificateDuration int
+	// Validity in months of the certificates of the classes missing from Validity (older configurations)
+	CertificateDuration int `json:",omitempty"`
+	// Default validity of the certificates of each class (root, intermediate, client): 20y, 6m, 90d, 12h...
+	Validity map[string]string
+	// How long before their signature certificates start to be valid, to allow for clock skew (5m, 1h...)
+	Backdate string
+	// How long CRLs are valid for, until the next one is generated (7d, 12h...)
+	CRLValidity string `json:",omitempty"`
+	// How long delta CRLs are valid for (they are usually published more often than base CRLs)
+	DeltaCRLValidity string `json:",omitempty"`
 	Organization string
 	Country string
 	Locality string
+	// Subject templates by class (root, intermediate, client), as RFC 4514 strings: "CN={{.Name}},OU={{.Team}}"
+	Subjects map[string]string `json:",omitempty"`
+	// Certificate profiles, in addition to (or replacing) the default ones
+	Profiles map[string]*Profile
+	// URLs of the issuer certificates, CRLs and OCSP responders by CA name ("*" for all CAs), added to the certificates
+	// the CAs issue
+	URLs map[string]*CAURLs `json:",omitempty"`
 }
 
 
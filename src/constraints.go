@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strings"
+)
+
+
+// The flags setting the name constraints of an intermediate CA
+type nameConstraintsFlags struct {
+	permittedDNS, excludedDNS stringArray
+	permittedIP, excludedIP stringArray
+	permittedEmail, excludedEmail stringArray
+	permittedURI, excludedURI stringArray
+}
+
+
+func (f *nameConstraintsFlags) addFlags(commands *flag.FlagSet) {
+	commands.Var(&f.permittedDNS, "permitted-dns", "")
+	commands.Var(&f.excludedDNS, "excluded-dns", "")
+	commands.Var(&f.permittedIP, "permitted-ip", "")
+	commands.Var(&f.excludedIP, "excluded-ip", "")
+	commands.Var(&f.permittedEmail, "permitted-email", "")
+	commands.Var(&f.excludedEmail, "excluded-email", "")
+	commands.Var(&f.permittedURI, "permitted-uri", "")
+	commands.Var(&f.excludedURI, "excluded-uri", "")
+}
+
+
+// The help of the flags registered by addFlags
+func getHelpNameConstraints() string {
+	return `--permitted-dns, --excluded-dns string
+	(optional, intermediate only) A DNS domain the intermediate can (or can't) issue certificates for, including its
+	subdomains ("domain.com"), or only its subdomains (".domain.com"). You can provide these parameters multiple times.
+
+--permitted-ip, --excluded-ip string
+	(optional, intermediate only) An IP range in the CIDR notation (10.0.0.0/8). You can provide these parameters
+	multiple times.
+
+--permitted-email, --excluded-email string
+	(optional, intermediate only) An email address, a domain ("domain.com") or the subdomains of a domain
+	(".domain.com"). You can provide these parameters multiple times.
+
+--permitted-uri, --excluded-uri string
+	(optional, intermediate only) A domain the hosts of URIs must be part of ("domain.com" for the host itself,
+	".domain.com" for its subdomains). You can provide these parameters multiple times.`
+}
+
+
+func (f *nameConstraintsFlags) isSet() bool {
+	return len(f.permittedDNS) + len(f.excludedDNS) + len(f.permittedIP) + len(f.excludedIP) + len(f.permittedEmail) + len(f.excludedEmail) + len(f.permittedURI) + len(f.excludedURI) > 0
+}
+
+
+// Set the name constraints on the certificate, they are marked critical
+func (f *nameConstraintsFlags) apply(cert *x509.Certificate) error {
+	var err error
+
+	if !f.isSet() {
+		return nil
+	}
+
+	cert.PermittedDNSDomains = f.permittedDNS
+	cert.ExcludedDNSDomains = f.excludedDNS
+	cert.PermittedEmailAddresses = f.permittedEmail
+	cert.ExcludedEmailAddresses = f.excludedEmail
+	cert.PermittedURIDomains = f.permittedURI
+	cert.ExcludedURIDomains = f.excludedURI
+
+	cert.PermittedIPRanges, err = parseIPRanges(f.permittedIP)
+	if err != nil {
+		return err
+	}
+
+	cert.ExcludedIPRanges, err = parseIPRanges(f.excludedIP)
+	if err != nil {
+		return err
+	}
+
+	cert.PermittedDNSDomainsCritical = true
+
+	return nil
+}
+
+
+func parseIPRanges(values []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+
+	for _, value := range values {
+		_, ipRange, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.New(value + " is not a valid IP range (e.g. 10.0.0.0/8)")
+		}
+
+		ranges = append(ranges, ipRange)
+	}
+
+	return ranges, nil
+}
+
+
+// The certificates of the CA and of its issuers, read from their current certificate files so a CA signed again is taken
+// into account. Only the issuers outside of the repository come from the full chain file of the CA they issued.
+func getIssuerChain(state *State, withElement *Element, withCertificate *x509.Certificate) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate = []*x509.Certificate{withCertificate}
+	var el *Element = withElement
+	var cert *x509.Certificate = withCertificate
+
+	for len(chain) <= len((*state).Intermediates) + 1 {
+		if isSelfSigned(cert) {
+			return chain, nil
+		}
+
+		issuer, err := getIssuerName(state, cert)
+		if err != nil {
+			if _, err = os.Stat(getFullCertPath((*el).Path)); os.IsNotExist(err) {
+				return chain, nil
+			}
+
+			_, fullchain, err := readCertificates(getFullCertPath((*el).Path))
+			if err != nil {
+				return nil, err
+			}
+
+			return append(chain, fullchain[1:]...), nil
+		}
+
+		var ok bool
+		el, ok = (*state).get("intermediate", issuer)
+		if !ok {
+			el, _ = (*state).get("root", issuer)
+		}
+
+		_, cert, err = loadCertificate((*el).Path)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, cert)
+	}
+
+	return nil, errors.New("the chain of " + withCertificate.Subject.CommonName + " loops")
+}
+
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+
+// Refuse to issue a certificate which would break the name constraints of a CA of its chain: clients would reject it
+func checkNameConstraints(cert *x509.Certificate, chain []*x509.Certificate) error {
+	for _, ca := range chain {
+		for _, dnsName := range cert.DNSNames {
+			if !isPermitted(dnsName, ca.PermittedDNSDomains, ca.ExcludedDNSDomains, matchDomain) {
+				return errors.New("the name constraints of " + ca.Subject.CommonName + " do not allow the DNS name " + dnsName)
+			}
+		}
+
+		for _, email := range cert.EmailAddresses {
+			if !isPermitted(email, ca.PermittedEmailAddresses, ca.ExcludedEmailAddresses, matchEmail) {
+				return errors.New("the name constraints of " + ca.Subject.CommonName + " do not allow the email address " + email)
+			}
+		}
+
+		for _, uri := range cert.URIs {
+			if !isPermitted(uri.Hostname(), ca.PermittedURIDomains, ca.ExcludedURIDomains, matchDomain) {
+				return errors.New("the name constraints of " + ca.Subject.CommonName + " do not allow the URI " + uri.String())
+			}
+		}
+
+		for _, ip := range cert.IPAddresses {
+			var permitted bool = len(ca.PermittedIPRanges) == 0
+
+			for _, ipRange := range ca.PermittedIPRanges {
+				permitted = permitted || ipRange.Contains(ip)
+			}
+			for _, ipRange := range ca.ExcludedIPRanges {
+				permitted = permitted && !ipRange.Contains(ip)
+			}
+
+			if !permitted {
+				return errors.New("the name constraints of " + ca.Subject.CommonName + " do not allow the IP address " + ip.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+
+// A name is permitted if it matches one of the permitted constraints (if any) and none of the excluded ones
+func isPermitted(name string, permitted, excluded []string, match func(name, constraint string) bool) bool {
+	var ok bool = len(permitted) == 0
+
+	for _, constraint := range permitted {
+		ok = ok || match(name, constraint)
+	}
+	for _, constraint := range excluded {
+		ok = ok && !match(name, constraint)
+	}
+
+	return ok
+}
+
+
+// "domain.com" matches the domain and its subdomains, ".domain.com" only its subdomains
+func matchDomain(name, constraint string) bool {
+	name = strings.ToLower(name)
+	constraint = strings.ToLower(constraint)
+
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+
+	return name == constraint || strings.HasSuffix(name, "." + constraint)
+}
+
+
+// A constraint containing a @ is a mailbox, else it is a domain ("domain.com" for this host only, ".domain.com" for
+// its subdomains)
+func matchEmail(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+
+	var host string = strings.ToLower(email[strings.LastIndex(email, "@") + 1:])
+	constraint = strings.ToLower(constraint)
+
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+
+	return host == constraint
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+
+// Used when the configuration has no CRLValidity or DeltaCRLValidity (configurations of older simpleca versions)
+const defaultCRLValidity = "7d"
+const defaultDeltaCRLValidity = "1d"
+
+var oidDeltaCRLIndicator asn1.ObjectIdentifier = asn1.ObjectIdentifier{2, 5, 29, 27}
+
+
+func getHelpCRL() string {
+	return `Usage: simpleca crl --with=<ca name> [--delta] [--next-update=<validity>] [--share=<file>]
+
+Generate the certificate revocation list (X.509 v2 CRL) of a CA, listing the certificates it revoked (see "simpleca
+revoke") which have not expired yet. The CRL is written in DER (<CA path>.crl, to publish at the CRLBaseURL of the
+configuration) and in PEM (<CA path>.crl.pem, for the ssl_crl directive of nginx for instance). Each CRL gets the next
+CRL number of the CA.
+
+With --delta, a delta CRL is generated instead: it only lists the certificates revoked since the last base CRL, so it
+stays small and can be published more often. It is written in <CA path>-delta.crl and <CA path>-delta.crl.pem. If the
+CA has a DeltaCRLBaseURL in the configuration, its base CRLs and the certificates it issues point to the delta CRL
+(Freshest CRL extension).
+
+--with string
+	The name of the CA (root or an intermediate).
+
+--delta
+	(optional) Generate a delta CRL, against the last base CRL of the CA.
+
+--next-update string
+	(optional) When the next CRL will be published, as a number followed by d (days) or h (hours). Defaults to the
+	CRLValidity of the configuration (7d if it is not set), or to its DeltaCRLValidity for delta CRLs (1d if it is not
+	set). Clients reject the CRL after this date.
+
+--share string
+	(optional) A share of the CA key, if it has been split with "simpleca split". Provide this parameter once per share.
+
+` + getHelpPassphrase("with-", "the CA key") + `
+
+` + getHelpAskpass()
+}
+
+
+func crl(state *State, conf Conf, with, nextUpdate string, delta bool, shares []string, withPass *passphraseSource) (string, error) {
+	if with == "" {
+		return "", errors.New("missing --with\n\n" + getHelpCRL())
+	}
+
+	withElement, err := getCA(state, with)
+	if err != nil {
+		return "", err
+	}
+
+	_, withCertificateX509, err := loadCertificate((*withElement).Path)
+	if err != nil {
+		return "", err
+	}
+
+	// CA certificates signed by simpleca versions without profiles can only sign certificates
+	if withCertificateX509.KeyUsage & x509.KeyUsageCRLSign == 0 {
+		var signCommand string = "simpleca sign root"
+		if _, ok := (*state).get("intermediate", with); ok {
+			issuer, err := getIssuerName(state, withCertificateX509)
+			if err != nil {
+				issuer = "<its CA>"
+			}
+			signCommand = "simpleca sign intermediate --name " + with + " --with " + issuer
+		}
+
+		return "", errors.New("the certificate of " + with + " can't sign CRLs (no crlSign key usage), it has probably been signed by an older simpleca version: sign it again with \"" + signCommand + "\"")
+	}
+
+	var now time.Time = time.Now()
+
+	// A delta CRL lists the revocations since the last base CRL, which it refers to
+	var since time.Time
+	var extensions []pkix.Extension
+	var crlPath, crlPemPath string = getCRLPath((*withElement).Path), getCRLPemPath((*withElement).Path)
+
+	if delta {
+		if (*withElement).BaseCRLNumber == 0 {
+			return "", errors.New(with + " has no base CRL yet, generate one first with \"simpleca crl --with " + with + "\"")
+		}
+
+		baseCRLNumber, err := asn1.Marshal(big.NewInt((*withElement).BaseCRLNumber))
+		if err != nil {
+			return "", err
+		}
+
+		if (*withElement).BaseCRLOn != nil {
+			since = *(*withElement).BaseCRLOn
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidDeltaCRLIndicator, Critical: true, Value: baseCRLNumber})
+		crlPath, crlPemPath = getDeltaCRLPath((*withElement).Path), getDeltaCRLPemPath((*withElement).Path)
+
+		if nextUpdate == "" {
+			nextUpdate = conf.DeltaCRLValidity
+		}
+		if nextUpdate == "" {
+			nextUpdate = defaultDeltaCRLValidity
+		}
+	} else {
+		freshestCRL, err := getFreshestCRLExtension(conf, with)
+		if err != nil {
+			return "", err
+		}
+		if freshestCRL != nil {
+			extensions = append(extensions, *freshestCRL)
+		}
+
+		if nextUpdate == "" {
+			nextUpdate = conf.CRLValidity
+		}
+		if nextUpdate == "" {
+			nextUpdate = defaultCRLValidity
+		}
+	}
+
+	nextUpdateTime, err := addValidity(now, nextUpdate)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := getRevokedEntries(state, with, now, since)
+	if err != nil {
+		return "", err
+	}
+
+	withPrivKey, err := loadCASigner(withElement, shares, withPass)
+	if err != nil {
+		return "", err
+	}
+	defer closeSigner(withPrivKey)
+
+	var number int64 = (*withElement).CRLNumber + 1
+
+	// The AuthorityKeyIdentifier is the SubjectKeyIdentifier of the CA certificate
+	revocationList, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number: big.NewInt(number),
+		ThisUpdate: now,
+		NextUpdate: nextUpdateTime,
+		RevokedCertificateEntries: entries,
+		ExtraExtensions: extensions,
+	}, withCertificateX509, withPrivKey)
+	if err != nil {
+		return "", errors.New("can't create the CRL of " + with + ": " + err.Error())
+	}
+
+	err = writeFileAtomic(crlPath, revocationList, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(crlPemPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: revocationList}), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	// Base and delta CRLs share the same sequence of numbers
+	(*withElement).CRLNumber = number
+
+	if delta {
+		return "Delta CRL number " + strconv.FormatInt(number, 10) + " of " + with + " (base CRL " + strconv.FormatInt((*withElement).BaseCRLNumber, 10) + ", " + strconv.Itoa(len(entries)) + " revoked certificates) available in " + crlPath + " and " + crlPemPath, nil
+	}
+
+	(*withElement).BaseCRLNumber = number
+	(*withElement).BaseCRLOn = &now
+
+	return "CRL number " + strconv.FormatInt(number, 10) + " of " + with + " (" + strconv.Itoa(len(entries)) + " revoked certificates) available in " + crlPath + " and " + crlPemPath, nil
+}
+
+
+// The certificates revoked by the CA which are still valid, since the given date (for delta CRLs)
+func getRevokedEntries(state *State, ca string, now, since time.Time) ([]x509.RevocationListEntry, error) {
+	var entries []x509.RevocationListEntry
+
+	for _, revocation := range (*state).Revocations[ca] {
+		if !(*revocation).ValidUntil.IsZero() && (*revocation).ValidUntil.Before(now) {
+			continue
+		}
+		if !since.IsZero() && !(*revocation).RevokedOn.After(since) {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString((*revocation).SerialNumber, 10)
+		if !ok {
+			return nil, errors.New("invalid serial number " + (*revocation).SerialNumber + " in the state")
+		}
+
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber: serial,
+			RevocationTime: (*revocation).RevokedOn,
+			// Unknown reasons are unspecified (0), which is left out of the CRL
+			ReasonCode: revocationReasons[(*revocation).Reason],
+		})
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+
+func getHelpCSR() string {
+	return `Usage: simpleca csr <class> [--name=<name>] [--altname=<altname>] [--ip=<ip>] [--email=<email>]
+                    [--uri=<uri>] [--no-cn-san] [--subject=<dn>] [--var=<name=value>] [--ou=<ou>]
+                    [--province=<province>] [--street=<street>] [--postal-code=<code>] [--subject-email=<email>]
+                    [--subject-serial=<serial>] [--out=<file>] [--share=<file>]
+
+Write a certificate signing request (PKCS#10) for a key of the repository, to get it signed by another CA (a corporate
+or public one for instance). The subject comes from the configuration, as for the "sign" command.
+
+Available classes:
+	root           create a request for the root CA key
+	intermediate   create a request for an intermediate CA key
+	client         create a request for a client key
+
+--name string
+	(optional) The name of the key, also used as CommonName.
+
+` + getHelpSubjectAltNames() + `
+
+` + getHelpSubject() + `
+
+--out string
+	(optional) The file to write the request to. Defaults to the key path with the .csr extension.
+
+--share string
+	(optional) A share of the key, if it has been split with "simpleca split". Provide this parameter once per share.
+
+` + getHelpPassphrase("", "the key") + `
+
+` + getHelpAskpass()
+}
+
+
+func csr(state *State, conf Conf, class, keyName string, sans *subjectAltNames, subjectFlags *subjectFlags, shares []string, out string, pass *passphraseSource) (string, error) {
+	var err error
+
+	switch class {
+	case "root":
+		keyName = "root"
+	case "intermediate":
+		if keyName == "" {
+			keyName = "intermediate"
+		}
+	case "client":
+		if keyName == "" {
+			keyName = "client"
+		}
+	default:
+		return "", errors.New("missing class\n\n" + getHelpCSR())
+	}
+
+	keyInState, ok := (*state).get(class, keyName)
+	if !ok {
+		return "", errors.New("key " + keyName + " is not known")
+	}
+
+	subject, err := getSubject(conf, class, "", nil, keyName, subjectFlags)
+	if err != nil {
+		return "", err
+	}
+
+	// As in the certificates of the class: CA certificates have no alternative names by default
+	profile, err := getProfile(conf, class, "")
+	if err != nil {
+		return "", err
+	}
+
+	names, err := sans.withCommonName(subject.CommonName, (*profile).CommonNameAsSAN)
+	if err != nil {
+		return "", err
+	}
+
+	signer, err := loadCASigner(keyInState, shares, pass)
+	if err != nil {
+		return "", err
+	}
+	defer closeSigner(signer)
+
+	// Same subject and names as the certificates signed by simpleca
+	var template *x509.CertificateRequest = &x509.CertificateRequest{
+		Subject: subject,
+		DNSNames: names.DNSNames,
+		IPAddresses: names.IPAddresses,
+		EmailAddresses: names.EmailAddresses,
+		URIs: names.URIs,
+	}
+
+	request, err := x509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return "", err
+	}
+
+	if out == "" {
+		out = getCSRPath((*keyInState).Path)
+	}
+
+	err = writeFileAtomic(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: request}), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return "Certificate signing request of " + keyName + " available in " + out, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+
+func getHelpImportEasyRSA() string {
+	return `Usage: simpleca import-easyrsa <pki folder>
+
+Create a simpleca repository in the current folder from an easy-rsa PKI (the folder containing ca.crt, index.txt,
+issued/ and private/).
+
+The CA becomes the root and every issued certificate becomes a client (with its private key if it is available in
+private/). Revoked certificates listed in index.txt are recorded as revoked by the root.
+
+If the private keys are encrypted, you will be prompted for their password to check they match their certificate.
+
+` + getHelpPassphrase("", "the private keys (the same one for all of them, otherwise it is asked for each key)") + `
+
+` + getHelpAskpass()
+}
+
+
+// Check the folder looks like an easy-rsa PKI
+func checkEasyRSA(pkiPath string) error {
+	var caCertPath string = filepath.Join(pkiPath, "ca.crt")
+
+	if _, err := os.Stat(caCertPath); os.IsNotExist(err) {
+		return errors.New(pkiPath + " does not look like an easy-rsa PKI: " + caCertPath + " does not exist")
+	}
+
+	return nil
+}
+
+
+func importEasyRSA(state *State, pkiPath string, pass *passphraseSource) (string, error) {
+	var err error
+
+	if pkiPath == "" {
+		return "", errors.New("missing easy-rsa PKI folder\n\n" + getHelpImportEasyRSA())
+	}
+
+	var caCertPath string = filepath.Join(pkiPath, "ca.crt")
+	var caKeyPath string = filepath.Join(pkiPath, "private", "ca.key")
+
+	err = checkEasyRSA(pkiPath)
+	if err != nil {
+		return "", err
+	}
+
+	// The CA key may have been kept elsewhere
+	if _, err = os.Stat(caKeyPath); os.IsNotExist(err) {
+		caKeyPath = ""
+	}
+
+	err = import_(state, "root", "root", caKeyPath, caCertPath, "", pass)
+	if err != nil {
+		return "", err
+	}
+
+	// Issued certificates
+	issued, err := filepath.Glob(filepath.Join(pkiPath, "issued", "*.crt"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, certPath := range issued {
+		var name string = strings.TrimSuffix(filepath.Base(certPath), ".crt")
+		var keyPath string = filepath.Join(pkiPath, "private", name + ".key")
+
+		if _, err = os.Stat(keyPath); os.IsNotExist(err) {
+			keyPath = ""
+		}
+
+		err = import_(state, "client", name, keyPath, certPath, "", pass)
+		if err != nil {
+			return "", errors.New("can't import " + certPath + ": " + err.Error())
+		}
+
+		err = writeFullChain(state, getPath("client", name))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Revocations
+	var indexPath string = filepath.Join(pkiPath, "index.txt")
+	var revoked int
+
+	if _, err = os.Stat(indexPath); os.IsNotExist(err) {
+		fmt.Println("Warning: " + indexPath + " does not exist, no revocation imported")
+	} else {
+		entries, err := readIndex(indexPath)
+		if err != nil {
+			return "", err
+		}
+
+		for _, entry := range entries {
+			if entry.Status == "R" {
+				(*state).revoke("root", entry.revocation())
+				revoked++
+			}
+		}
+	}
+
+	return "easy-rsa PKI imported: " + strconv.Itoa(len(issued)) + " certificates, " + strconv.Itoa(revoked) +
+		" revocations", nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/pem"
@@ -16,7 +17,7 @@ import (
 
 
 func getHelpGenerate() string {
-	return `Usage: simpleca generate <class> [--type=<type>] [--size=<size>] [--name=<name>] [--clear-text]
+	return `Usage: simpleca generate <class> [--type=<type>] [--size=<size>] [--name=<name>] [--clear-text] [--pkcs11=<uri>]
 
 Generate a new key pair.
 
@@ -26,26 +27,42 @@ Available classes:
 	client         generate a client key pair
 
 --type string
-	(optional) The key type. Possible values: "ecdsa", "rsa". Defaults to "ecdsa".
+	(optional) The key type. Possible values: "ecdsa", "ed25519", "rsa". Defaults to "ecdsa".
 
 --size string
 	(optional) The key size (depends on the key type). Possible values: "224", "256", "384", "521" for EC key types;
-	"1024", "2048", "4096" for RSA. Defaults to "256".
+	"1024", "2048", "4096" for RSA. Defaults to "256". Ed25519 keys always have a fixed size of 256 bits.
 
 --name string
 	(optional) The key name. This allows you to have multiple key of the same class (this is particularly useful to have
 	multiple client keys).
 
 --clear-text
-	(optional) If provided, do not encrypt generated private key. This is not recommended.`
+	(optional) If provided, do not encrypt generated private key. This is not recommended.
+
+--pkcs11 string
+	(optional) Generate the key on a PKCS#11 token (root and intermediate only) instead of on disk. The value is a
+	PKCS#11 URI giving the token and the label of the key, for instance:
+	"pkcs11:token=simpleca;object=root?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-source=file:/run/pin".
+	The PIN is asked for if the URI contains neither pin-value nor pin-source. pin-value is only used to generate
+	the key, it is not stored in the repository. Only ECDSA and RSA keys are supported, and pkcs11-tool (from OpenSC)
+	must be installed.
+
+` + getHelpPassphrase("", "the generated key (or the PIN of the PKCS#11 token)") + `
+
+` + getHelpAskpass()
 }
 
 
-func generate(state *State, conf Conf, class string, keySize int, keyType, keyName string, clearText bool) error {
+func generate(state *State, conf Conf, class string, keySize int, keyType, keyName string, clearText bool, pkcs11 string, pass *passphraseSource) error {
 	if keyType == "" {
 		keyType = "ecdsa"
 	}
 
+	if pkcs11 != "" {
+		return generatePKCS11(state, class, keySize, keyType, keyName, pkcs11, pass)
+	}
+
 	var err error
 
 	// Generate keys
@@ -71,6 +88,16 @@ func generate(state *State, conf Conf, class string, keySize int, keyType, keyNa
 			keySize = 384
 		}
 
+		privKeyMarshalled, pubKeyMarshalled, privateHeader, publicHeader, err = generateKey(keyType, keySize)
+		if err != nil {
+			return err
+		}
+	case "ed25519":
+		// Ed25519 keys can't have any other size
+		if keySize == 0 {
+			keySize = 256
+		}
+
 		privKeyMarshalled, pubKeyMarshalled, privateHeader, publicHeader, err = generateKey(keyType, keySize)
 		if err != nil {
 			return err
@@ -100,6 +127,11 @@ func generate(state *State, conf Conf, class string, keySize int, keyType, keyNa
 		return errors.New("can't generate a " + class)
 	}
 
+	err = checkName(keyName)
+	if err != nil {
+		return err
+	}
+
 	// Generate the folder if needed
 	if _, err = os.Stat(path); os.IsNotExist(err) {
 		err = os.Mkdir(path, 0700)
@@ -125,27 +157,21 @@ func generate(state *State, conf Conf, class string, keySize int, keyType, keyNa
 	defer pubKeyFile.Close()
 
 	if !clearText {
-		// Ask private key password
 		var password string
-		var passwordCheck string = "different"
+		var privKey interface{}
 
-		for password != passwordCheck {
-			password, err = getpass("Please provide the password for the file " + privKeyPath + ": ")
-			if err != nil {
-				return err
-			}
-			passwordCheck, err = getpass("Please repeat it: ")
-			if err != nil {
-				return err
-			}
+		password, err = askNewPassword(privKeyPath, pass)
+		if err != nil {
+			return err
+		}
 
-			if password != passwordCheck {
-				fmt.Println("Passwords don't match")
-			}
+		// Encrypt private key (as PKCS#8, whatever its type)
+		privKey, err = parsePrivKey(keyType, privKeyMarshalled)
+		if err != nil {
+			return err
 		}
 
-		// Encrypt private key
-		encryptedPrivKey, err = x509.EncryptPEMBlock(rand.Reader, privateHeader, privKeyMarshalled, []byte(password), x509.PEMCipherAES256)
+		encryptedPrivKey, err = encodePrivKey(privKey, password, false)
 		if err != nil {
 			return err
 		}
@@ -159,12 +185,11 @@ func generate(state *State, conf Conf, class string, keySize int, keyType, keyNa
 
 	// Update State
 	(*state).set(class, keyName, &Element{
-		getPath(class, keyName),
-		keyType,
-		keySize,
-		time.Now(),
-		time.Now(),
-		"",
+		Path: getPath(class, keyName),
+		Type: keyType,
+		Size: keySize,
+		CreatedOn: time.Now(),
+		ValidUntil: time.Now(),
 	})
 
 	fmt.Println("Encrypted key generated in " + privKeyPath)
@@ -228,6 +253,27 @@ func generateKey(keyType string, keySize int) (privKeyMarshalled, pubKeyMarshall
 		}
 
 		return privKeyMarshalled, pubKeyMarshalled, "EC PRIVATE KEY", "EC PUBLIC KEY", nil
+	case "ed25519":
+		if keySize != 256 {
+			return []byte{}, []byte{}, "", "", errors.New(keySizeStr + " bits is not a valid size for an Ed25519 key (only 256 is)")
+		}
+
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return []byte{}, []byte{}, "", "", err
+		}
+
+		// There is no specific format for Ed25519 private keys, PKCS#8 is the standard one
+		privKeyMarshalled, err = x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			return []byte{}, []byte{}, "", "", err
+		}
+		pubKeyMarshalled, err = x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			return []byte{}, []byte{}, "", "", err
+		}
+
+		return privKeyMarshalled, pubKeyMarshalled, "PRIVATE KEY", "PUBLIC KEY", nil
 	}
 
 	return []byte{}, []byte{}, "", "", nil
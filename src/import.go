@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+
+func getHelpImport() string {
+	return `Usage: simpleca import <class> [--name=<name>] [--key=<file>] [--cert=<file>] [--chain=<file>]
+
+Import an existing private key and/or certificate (generated with openssl or any other tool) into the repository.
+
+The key type and size are detected, and the serial number and validity are read from the certificate. If both a key
+and a certificate are given, they must match. The private key is copied as is (encrypted or not).
+
+A certificate can also be imported for a key already in the repository (a certificate signed by an external CA from a
+request written with "simpleca csr"), it must match the public key. If its issuer is not a CA of the repository, it is
+recorded as external: give its chain with --chain to get full chain certificate files.
+
+Available classes:
+	root           import a root CA
+	intermediate   import an intermediate CA
+	client         import a client
+
+--name string
+	(optional) The name of the imported element.
+
+--key string
+	(optional) The PEM encoded private key file.
+
+--cert string
+	(optional) The PEM encoded certificate file. If it contains more than one certificate, the following ones are
+	considered to be the chain and a full chain certificate file is created as well.
+
+--chain string
+	(optional) The PEM encoded certificates of the chain of the certificate, starting with its issuer. A full chain
+	certificate file is created, and is used for the full chain certificate files of the keys signed by this CA.
+
+` + getHelpPassphrase("", "the imported key") + `
+
+` + getHelpAskpass()
+}
+
+
+// Can't call it import() because of go
+func import_(state *State, class, keyName, keyFile, certFile, chainFile string, pass *passphraseSource) error {
+	var err error
+
+	if keyFile == "" && certFile == "" {
+		return errors.New("at least one of --key or --cert must be given")
+	}
+
+	if chainFile != "" && certFile == "" {
+		return errors.New("--chain can only be used with --cert")
+	}
+
+	switch class {
+	case "root":
+		keyName = "root"
+	case "intermediate":
+		if keyName == "" {
+			keyName = "intermediate"
+		}
+	case "client":
+		if keyName == "" {
+			keyName = "client"
+		}
+	default:
+		return errors.New("can't import a " + class)
+	}
+
+	err = checkName(keyName)
+	if err != nil {
+		return err
+	}
+
+	var privKeyPem *pem.Block
+	var pubKey interface{}
+	var certs []*x509.Certificate
+	var certsPem []*pem.Block
+
+	// Only the certificate of an existing key can be imported
+	el, exists := (*state).get(class, keyName)
+	if exists {
+		if keyFile != "" {
+			return errors.New(class + " " + keyName + " already exists")
+		}
+
+		pubKey, err = loadPubKey((*el).Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if keyFile != "" {
+		var privKey interface{}
+
+		privKeyPem, err = readPemFile(keyFile, "PRIVATE KEY")
+		if err != nil {
+			return err
+		}
+
+		privKey, _, err = decryptPrivKey("", privKeyPem, keyFile, pass)
+		if err != nil {
+			return err
+		}
+
+		pubKey = getPubKey(privKey)
+	}
+
+	if certFile != "" {
+		certsPem, certs, err = readCertificates(certFile)
+		if err != nil {
+			return err
+		}
+
+		// Check the key and the certificate match
+		if pubKey != nil {
+			keyDer, err := x509.MarshalPKIXPublicKey(pubKey)
+			if err != nil {
+				return err
+			}
+
+			certKeyDer, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+			if err != nil {
+				return err
+			}
+
+			if !bytes.Equal(keyDer, certKeyDer) {
+				if exists {
+					return errors.New("the certificate " + certFile + " does not match the public key of " + keyName)
+				}
+				return errors.New("the private key " + keyFile + " does not match the certificate " + certFile)
+			}
+		}
+
+		pubKey = certs[0].PublicKey
+
+		if class != "client" && !certs[0].IsCA {
+			return errors.New("the certificate " + certFile + " is not a CA certificate, it can't be imported as a " + class)
+		}
+
+		if chainFile != "" {
+			chainPem, chain, err := readCertificates(chainFile)
+			if err != nil {
+				return err
+			}
+
+			certsPem = append(certsPem, chainPem...)
+			certs = append(certs, chain...)
+		}
+
+		if len(certs) > 1 && certs[0].CheckSignatureFrom(certs[1]) != nil {
+			return errors.New("the certificate " + certFile + " has not been issued by the first certificate of its chain")
+		}
+	}
+
+	var keyType string = getKeyType(pubKey)
+	if keyType == "" {
+		return errors.New("unsupported key type")
+	}
+
+	// Write files
+	var path string = getPath(class, keyName)
+
+	if privKeyPem != nil {
+		err = writeFileAtomic(getPrivKeyPath(path), pem.EncodeToMemory(privKeyPem), 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !exists {
+		pubKeyPem, err := encodePubKey(pubKey)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(getPubKeyPath(path), pem.EncodeToMemory(pubKeyPem), 0644)
+		if err != nil {
+			return err
+		}
+
+		el = &Element{
+			Path: path,
+			Type: keyType,
+			Size: getKeySize(pubKey),
+			CreatedOn: time.Now(),
+			ValidUntil: time.Now(),
+		}
+	}
+
+	if len(certs) > 0 {
+		err = writeFileAtomic(getCertPath(path), pem.EncodeToMemory(certsPem[0]), 0600)
+		if err != nil {
+			return err
+		}
+
+		if class != "client" {
+			err = writeFileAtomic(getCertDerPath(path), certs[0].Raw, 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(certs) > 1 {
+			var fullchain []byte
+
+			for _, certPem := range certsPem {
+				fullchain = append(fullchain, pem.EncodeToMemory(certPem)...)
+			}
+
+			err = writeFileAtomic(getFullCertPath(path), fullchain, 0600)
+			if err != nil {
+				return err
+			}
+		} else if _, err = os.Stat(getFullCertPath(path)); err == nil {
+			// Do not leave the chain of a previous certificate
+			err = os.Remove(getFullCertPath(path))
+			if err != nil {
+				return err
+			}
+		}
+
+		(*el).ValidUntil = certs[0].NotAfter
+		(*el).SerialNumber = certs[0].SerialNumber.String()
+		(*el).ExternalIssuer = getExternalIssuer(state, certs[0])
+	}
+
+	(*state).set(class, keyName, el)
+
+	if exists {
+		fmt.Println("Certificate of " + class + " " + keyName + " imported in " + getCertPath(path))
+	} else {
+		fmt.Println(class + " " + keyName + " imported in " + path)
+	}
+
+	if (*el).ExternalIssuer != "" && len(certs) == 1 {
+		fmt.Println("Warning: the certificate is issued by the external CA " + (*el).ExternalIssuer + ", give its chain with --chain to get full chain certificate files")
+	}
+
+	return nil
+}
+
+
+// Like `sign` does, provide a full chain certificate file for a client imported without its chain, once its issuer is
+// in the repository
+func writeFullChain(state *State, path string) error {
+	if _, err := os.Stat(getFullCertPath(path)); !os.IsNotExist(err) {
+		return nil
+	}
+
+	certPem, cert, err := loadCertificate(path)
+	if err != nil {
+		return err
+	}
+
+	issuer, err := getIssuerName(state, cert)
+	if err != nil {
+		// Issued by an external CA, its chain is unknown
+		return nil
+	}
+
+	ca, ok := (*state).get("intermediate", issuer)
+	if !ok {
+		ca, _ = (*state).get("root", issuer)
+	}
+
+	_, caCert, err := loadCertificate((*ca).Path)
+	if err != nil {
+		return err
+	}
+
+	chain, _, err := getCAChain(state, ca, caCert)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(getFullCertPath(path), append(pem.EncodeToMemory(certPem), chain...), 0600)
+}
+
+
+// Return the issuer of the certificate if it is neither self-signed nor issued by a CA of the repository
+func getExternalIssuer(state *State, cert *x509.Certificate) string {
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil {
+		return ""
+	}
+
+	for _, elements := range []map[string]*Element{(*state).Root, (*state).Intermediates} {
+		for _, el := range elements {
+			if (*el).SerialNumber == "" {
+				continue
+			}
+
+			_, caCert, err := loadCertificate((*el).Path)
+			if err != nil {
+				continue
+			}
+
+			if cert.CheckSignatureFrom(caCert) == nil {
+				return ""
+			}
+		}
+	}
+
+	return cert.Issuer.String()
+}
+
+
+// Return the first PEM block of the file whose type ends with the given suffix (openssl may put other blocks, like EC
+// parameters, before the one we want)
+func readPemFile(file, typeSuffix string) (*pem.Block, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		if strings.HasSuffix(block.Type, typeSuffix) {
+			return block, nil
+		}
+	}
+
+	return nil, errors.New("no " + typeSuffix + " found in " + file)
+}
+
+
+// Read all certificates of a PEM file
+func readCertificates(file string) ([]*pem.Block, []*x509.Certificate, error) {
+	var certsPem []*pem.Block
+	var certs []*x509.Certificate
+
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, nil, errors.New("certificate " + file + " does not exist")
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		var block *pem.Block
+
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, errors.New("can't parse a certificate of " + file + ": " + err.Error())
+		}
+
+		certsPem = append(certsPem, block)
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, nil, errors.New("no certificate found in " + file)
+	}
+
+	return certsPem, certs, nil
+}
@@ -79,10 +79,18 @@ func init_() error {
 
 		// No config file: create one
 		var conf Conf = Conf{
-			36,
-			"SimpleCA",
-			"France",
-			"Paris",
+			Validity: map[string]string{
+				"root": "20y",
+				"intermediate": "5y",
+				"client": "90d",
+			},
+			Backdate: "5m",
+			CRLValidity: "7d",
+			DeltaCRLValidity: "1d",
+			Organization: "SimpleCA",
+			Country: "France",
+			Locality: "Paris",
+			Profiles: getDefaultProfiles(),
 		}
 
 		b, err := json.MarshalIndent(conf, "", "    ")
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -16,10 +17,22 @@ func getHelp() string {
 	return `Usage: simpleca <action>
 
 Available actions:
+	agent
+	crl
+	csr
+	export-openssl
 	generate
+	import
+	import-easyrsa
+	import-openssl
 	init
+	migrate-keys
+	passwd
+	revoke
 	rm
 	sign
+	sign-csr
+	split
 	version`
 }
 
@@ -73,19 +86,66 @@ func run() (string, error) {
 		switch topic {
 		case "":
 			return getHelp(), nil
+		case "agent":
+			return getHelpAgent(), nil
+		case "crl":
+			return getHelpCRL(), nil
+		case "csr":
+			return getHelpCSR(), nil
 		case "rm":
 			return getHelpRm(), nil
+		case "export-openssl":
+			return getHelpExportOpenSSL(), nil
 		case "generate":
 			return getHelpGenerate(), nil
+		case "import":
+			return getHelpImport(), nil
+		case "import-easyrsa":
+			return getHelpImportEasyRSA(), nil
+		case "import-openssl":
+			return getHelpImportOpenSSL(), nil
 		case "init":
 			return getHelpInit(), nil
+		case "migrate-keys":
+			return getHelpMigrateKeys(), nil
+		case "passwd":
+			return getHelpPasswd(), nil
+		case "revoke":
+			return getHelpRevoke(), nil
 		case "sign":
 			return getHelpSign(), nil
+		case "sign-csr":
+			return getHelpSignCSR(), nil
+		case "split":
+			return getHelpSplit(), nil
 		default:
 			return "", errors.New("the action \"" + topic + "\" has no help available\n\n" + getHelp())
 		}
 	case "version":
 		return "simpleca v" + VERSION, nil
+	case "agent":
+		// Adding and removing keys needs the repository
+		if len(os.Args) < 3 || (os.Args[2] != "add" && os.Args[2] != "remove") {
+			return agent(os.Args[2:])
+		}
+	case "import-easyrsa", "import-openssl":
+		// Check the PKI to import first, not to leave an empty repository behind a mistyped path
+		if len(os.Args[2:]) >= 1 {
+			if action == "import-easyrsa" {
+				err = checkEasyRSA(os.Args[2])
+			} else {
+				err = checkOpenSSL(os.Args[2])
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+
+		// The repository is created from the imported PKI
+		err = init_()
+		if err != nil {
+			return "", err
+		}
 	}
 
 	if ! isRepo() {
@@ -116,6 +176,8 @@ Please run "simpleca init" before running any other command.
 		var keyType string
 		var keyName string
 		var clearText bool = false
+		var pkcs11 string
+		var pass passphraseSource
 
 		commands := flag.NewFlagSet("generate", flag.ExitOnError)
 
@@ -123,10 +185,216 @@ Please run "simpleca init" before running any other command.
 		commands.IntVar(&keySize, "size", 0, "")
 		commands.StringVar(&keyName, "name", "", "")
 		commands.BoolVar(&clearText, "clear-text", false, "")
+		commands.StringVar(&pkcs11, "pkcs11", "", "")
+		pass.addFlags(commands, "")
+
+		commands.Parse(os.Args[3:])
+
+		err = generate(&state, conf, class, keySize, keyType, keyName, clearText, pkcs11, &pass)
+		if err != nil {
+			return "", err
+		}
+	case "agent":
+		var subAction string = os.Args[2]
+		var class string
+		var keyName string
+		var all bool
+		var lifetime time.Duration
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet("agent " + subAction, flag.ExitOnError)
+
+		commands.StringVar(&keyName, "name", "", "")
+		commands.BoolVar(&all, "all", false, "")
+		commands.DurationVar(&lifetime, "lifetime", 0, "")
+		pass.addFlags(commands, "")
+
+		if len(os.Args[3:]) >= 1 && !strings.HasPrefix(os.Args[3], "-") {
+			class = os.Args[3]
+			commands.Parse(os.Args[4:])
+		} else {
+			commands.Parse(os.Args[3:])
+		}
+
+		msg, err = agentKeys(&state, subAction, class, keyName, all, lifetime, &pass)
+		if err != nil {
+			return "", err
+		}
+	case "crl":
+		var with string
+		var nextUpdate string
+		var delta bool
+		var shares stringArray
+		var withPass passphraseSource
+
+		commands := flag.NewFlagSet("crl", flag.ExitOnError)
+
+		commands.StringVar(&with, "with", "", "")
+		commands.StringVar(&nextUpdate, "next-update", "", "")
+		commands.BoolVar(&delta, "delta", false, "")
+		commands.Var(&shares, "share", "")
+		withPass.addFlags(commands, "with-")
+
+		commands.Parse(os.Args[2:])
+
+		msg, err = crl(&state, conf, with, nextUpdate, delta, shares, &withPass)
+		if err != nil {
+			return "", err
+		}
+	case "csr":
+		if len(os.Args[2:]) < 1 {
+			return "", errors.New("missing class\n\n" + getHelpCSR())
+		}
+
+		var class string = os.Args[2]
+		var keyName string
+		var out string
+		var shares stringArray
+		var sansFlags subjectAltNamesFlags
+		var subject subjectFlags
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet("csr", flag.ExitOnError)
+
+		commands.StringVar(&keyName, "name", "", "")
+		commands.StringVar(&out, "out", "", "")
+		commands.Var(&shares, "share", "")
+		sansFlags.addFlags(commands)
+		subject.addFlags(commands)
+		pass.addFlags(commands, "")
+
+		commands.Parse(os.Args[3:])
+
+		sans, err := sansFlags.get()
+		if err != nil {
+			return "", err
+		}
+
+		msg, err = csr(&state, conf, class, keyName, sans, &subject, shares, out, &pass)
+		if err != nil {
+			return "", err
+		}
+	case "import":
+		if len(os.Args[2:]) < 1 {
+			return "", errors.New("missing class\n\n" + getHelpImport())
+		}
+
+		var class string = os.Args[2]
+		var keyName string
+		var keyFile string
+		var certFile string
+		var chainFile string
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet("import", flag.ExitOnError)
+
+		commands.StringVar(&keyName, "name", "", "")
+		commands.StringVar(&keyFile, "key", "", "")
+		commands.StringVar(&certFile, "cert", "", "")
+		commands.StringVar(&chainFile, "chain", "", "")
+		pass.addFlags(commands, "")
+
+		commands.Parse(os.Args[3:])
+
+		err = import_(&state, class, keyName, keyFile, certFile, chainFile, &pass)
+		if err != nil {
+			return "", err
+		}
+	case "import-easyrsa":
+		var pkiPath string
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet("import-easyrsa", flag.ExitOnError)
+
+		pass.addFlags(commands, "")
+
+		if len(os.Args[2:]) >= 1 {
+			pkiPath = os.Args[2]
+			commands.Parse(os.Args[3:])
+		}
+
+		msg, err = importEasyRSA(&state, pkiPath, &pass)
+		if err != nil {
+			return "", err
+		}
+	case "import-openssl", "export-openssl":
+		var folder string
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet(action, flag.ExitOnError)
+
+		if action == "import-openssl" {
+			pass.addFlags(commands, "")
+		}
+
+		if len(os.Args[2:]) >= 1 {
+			folder = os.Args[2]
+			commands.Parse(os.Args[3:])
+		}
+
+		if action == "import-openssl" {
+			msg, err = importOpenSSL(&state, folder, &pass)
+		} else {
+			msg, err = exportOpenSSL(&state, folder)
+		}
+		if err != nil {
+			return "", err
+		}
+	case "migrate-keys":
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet("migrate-keys", flag.ExitOnError)
+
+		pass.addFlags(commands, "")
+
+		commands.Parse(os.Args[2:])
+
+		msg, err = migrateKeys(&state, &pass)
+		if err != nil {
+			return "", err
+		}
+	case "passwd":
+		if len(os.Args[2:]) < 1 {
+			return "", errors.New("missing class\n\n" + getHelpPasswd())
+		}
+
+		var class string = os.Args[2]
+		var keyName string
+		var encrypt bool = false
+		var decrypt bool = false
+		var pass, newPass passphraseSource
+
+		commands := flag.NewFlagSet("passwd", flag.ExitOnError)
+
+		commands.StringVar(&keyName, "name", "", "")
+		commands.BoolVar(&encrypt, "encrypt", false, "")
+		commands.BoolVar(&decrypt, "decrypt", false, "")
+		pass.addFlags(commands, "")
+		newPass.addFlags(commands, "new-")
+
+		commands.Parse(os.Args[3:])
+
+		err = passwd(&state, class, keyName, encrypt, decrypt, &pass, &newPass)
+		if err != nil {
+			return "", err
+		}
+	case "revoke":
+		if len(os.Args[2:]) < 1 {
+			return "", errors.New("missing class\n\n" + getHelpRevoke())
+		}
+
+		var class string = os.Args[2]
+		var keyName string
+		var reason string
+
+		commands := flag.NewFlagSet("revoke", flag.ExitOnError)
+
+		commands.StringVar(&keyName, "name", "", "")
+		commands.StringVar(&reason, "reason", "", "")
 
 		commands.Parse(os.Args[3:])
 
-		err = generate(&state, conf, class, keySize, keyType, keyName, clearText)
+		msg, err = revoke(&state, class, keyName, reason)
 		if err != nil {
 			return "", err
 		}
@@ -177,18 +445,104 @@ If you want to get rid of this CA, remove the whole folder (or better: create a
 		var class string = os.Args[2]
 		var keyName string
 		var with string
+		var profile string
 
 		commands := flag.NewFlagSet("sign", flag.ExitOnError)
 
-		var altNames stringArray
+		var shares stringArray
+		var sansFlags subjectAltNamesFlags
+		var subject subjectFlags
+		var constraints nameConstraintsFlags
+		var policies policyFlags
+		var maxPathLen string
+		var validity validityFlags
+		var pass, withPass passphraseSource
 
 		commands.StringVar(&keyName, "name", "", "")
 		commands.StringVar(&with, "with", "", "")
-		commands.Var(&altNames, "altname", "")
+		commands.StringVar(&profile, "profile", "", "")
+		commands.Var(&shares, "share", "")
+		sansFlags.addFlags(commands)
+		subject.addFlags(commands)
+		constraints.addFlags(commands)
+		policies.addFlags(commands)
+		commands.StringVar(&maxPathLen, "max-path-len", "", "")
+		validity.addFlags(commands)
+		pass.addFlags(commands, "")
+		withPass.addFlags(commands, "with-")
+
+		commands.Parse(os.Args[3:])
+
+		sans, err := sansFlags.get()
+		if err != nil {
+			return "", err
+		}
+
+		err = sign(&state, conf, class, with, keyName, profile, maxPathLen, sans, &subject, &constraints, &policies, &validity, shares, &pass, &withPass)
+		if err != nil {
+			return "", err
+		}
+	case "sign-csr":
+		var csrFile string
+		var keyName string
+		var with string
+		var profile string
+		var shares stringArray
+		var sansFlags subjectAltNamesFlags
+		var subject subjectFlags
+		var policies policyFlags
+		var validity validityFlags
+		var withPass passphraseSource
+
+		commands := flag.NewFlagSet("sign-csr", flag.ExitOnError)
+
+		commands.StringVar(&csrFile, "csr", "", "")
+		commands.StringVar(&keyName, "name", "", "")
+		commands.StringVar(&with, "with", "", "")
+		commands.StringVar(&profile, "profile", "", "")
+		commands.Var(&shares, "share", "")
+		sansFlags.addFlags(commands)
+		subject.addFlags(commands)
+		policies.addFlags(commands)
+		validity.addFlags(commands)
+		withPass.addFlags(commands, "with-")
+
+		commands.Parse(os.Args[2:])
+
+		sans, err := sansFlags.get()
+		if err != nil {
+			return "", err
+		}
+
+		msg, err = signCSR(&state, conf, csrFile, with, keyName, profile, sans, &subject, &policies, &validity, shares, &withPass)
+		if err != nil {
+			return "", err
+		}
+	case "split":
+		if len(os.Args[2:]) < 1 {
+			return "", errors.New("missing class\n\n" + getHelpSplit())
+		}
+
+		var class string = os.Args[2]
+		var shares, threshold int
+		var out string
+		var printShares, removeKey bool
+		var shareFiles stringArray
+		var pass passphraseSource
+
+		commands := flag.NewFlagSet("split", flag.ExitOnError)
+
+		commands.IntVar(&shares, "shares", 0, "")
+		commands.IntVar(&threshold, "threshold", 0, "")
+		commands.StringVar(&out, "out", ".", "")
+		commands.BoolVar(&printShares, "print", false, "")
+		commands.BoolVar(&removeKey, "remove-key", false, "")
+		commands.Var(&shareFiles, "share", "")
+		pass.addFlags(commands, "")
 
 		commands.Parse(os.Args[3:])
 
-		err := sign(&state, conf, class, with, keyName, altNames)
+		msg, err = split(&state, class, shares, threshold, out, printShares, removeKey, shareFiles, &pass)
 		if err != nil {
 			return "", err
 		}
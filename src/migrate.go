@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+
+func getHelpMigrateKeys() string {
+	return `Usage: simpleca migrate-keys
+
+Re-encrypt all private keys known in the state that still use the legacy OpenSSL encryption (DEK-Info header) with the
+PKCS#8 format (PBES2, PBKDF2 and AES-256). Each key is rewritten in place with the same password.
+
+Keys stored in clear text or already using PKCS#8 encryption are left untouched.
+
+` + getHelpPassphrase("", "the keys (the same one for all of them, otherwise it is asked for each key)") + `
+
+` + getHelpAskpass()
+}
+
+
+func migrateKeys(state *State, pass *passphraseSource) (string, error) {
+	var migrated int
+
+	// Walk the state in a stable order: root first, then intermediates and clients
+	for _, class := range []string{"root", "intermediate", "client"} {
+		var elements map[string]*Element
+
+		switch class {
+		case "root":
+			elements = (*state).Root
+		case "intermediate":
+			elements = (*state).Intermediates
+		case "client":
+			elements = (*state).Clients
+		}
+
+		var names []string
+		for name := range elements {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			var el *Element = elements[name]
+			var privKeyPath string = getPrivKeyPath((*el).Path)
+
+			// Some elements may not have a private key on disk
+			if _, err := os.Stat(privKeyPath); os.IsNotExist(err) {
+				continue
+			}
+
+			privKeyPem, err := readPrivKey((*el).Path)
+			if err != nil {
+				return "", err
+			}
+
+			if privKeyPem.Type == EncryptedPrivKeyHeader || !x509.IsEncryptedPEMBlock(privKeyPem) {
+				continue
+			}
+
+			privKey, password, err := unlockPrivKey((*el).Type, (*el).Path, pass)
+			if err != nil {
+				return "", err
+			}
+
+			encryptedPrivKey, err := encodePrivKey(privKey, password, false)
+			if err != nil {
+				return "", err
+			}
+
+			err = writeFileAtomic(privKeyPath, pem.EncodeToMemory(encryptedPrivKey), 0600)
+			if err != nil {
+				return "", err
+			}
+
+			fmt.Println(privKeyPath + " migrated")
+			migrated++
+		}
+	}
+
+	return strconv.Itoa(migrated) + " keys migrated", nil
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+func getHelpExportOpenSSL() string {
+	return `Usage: simpleca export-openssl <folder>
+
+Write the state as an OpenSSL CA database (the index.txt and serial files used by "openssl ca") in the given folder.
+
+All signed certificates of the repository are listed, along with the revoked certificates which have been removed since.`
+}
+
+func getHelpImportOpenSSL() string {
+	return `Usage: simpleca import-openssl <folder>
+
+Create a simpleca repository in the current folder from an "openssl ca" folder (the folder containing cacert.pem,
+index.txt, newcerts/ and private/).
+
+The CA becomes the root and every certificate of the database found in newcerts/ becomes a client (or an intermediate if
+it is a CA certificate), named after its CommonName. Revoked certificates are recorded as revoked by the root.
+
+If the CA private key is encrypted, you will be prompted for its password to check it matches its certificate.
+
+` + getHelpPassphrase("", "the CA private key") + `
+
+` + getHelpAskpass()
+}
+
+
+// Check the folder looks like an "openssl ca" folder
+func checkOpenSSL(folder string) error {
+	var caCertPath string = filepath.Join(folder, "cacert.pem")
+
+	if _, err := os.Stat(caCertPath); os.IsNotExist(err) {
+		return errors.New(folder + " does not look like an OpenSSL CA folder: " + caCertPath + " does not exist")
+	}
+
+	return nil
+}
+
+
+// An entry of an OpenSSL CA database (index.txt)
+type indexEntry struct {
+	// V (valid), R (revoked) or E (expired)
+	Status string
+	ValidUntil time.Time
+	RevokedOn time.Time
+	Reason string
+	SerialNumber *big.Int
+	Subject string
+}
+
+
+func (e *indexEntry) commonName() string {
+	var commonName string
+
+	for _, rdn := range strings.Split(e.Subject, "/") {
+		if strings.HasPrefix(rdn, "CN=") {
+			commonName = strings.TrimPrefix(rdn, "CN=")
+		}
+	}
+
+	return commonName
+}
+
+
+func (e *indexEntry) revocation() *Revocation {
+	return &Revocation{
+		Name: e.commonName(),
+		SerialNumber: e.SerialNumber.String(),
+		RevokedOn: e.RevokedOn,
+		Reason: e.Reason,
+		ValidUntil: e.ValidUntil,
+		Subject: e.Subject,
+	}
+}
+
+
+// The line as written in index.txt: status, expiration date, revocation date[,reason], serial number (hex), file name, DN
+func (e *indexEntry) String() string {
+	var revocation string
+
+	if e.Status == "R" {
+		revocation = formatIndexTime(e.RevokedOn)
+		if e.Reason != "" && e.Reason != "unspecified" {
+			revocation += "," + e.Reason
+		}
+	}
+
+	return strings.Join([]string{e.Status, formatIndexTime(e.ValidUntil), revocation, formatSerialHex(e.SerialNumber), "unknown", e.Subject}, "\t")
+}
+
+
+func exportOpenSSL(state *State, folder string) (string, error) {
+	var err error
+
+	if folder == "" {
+		return "", errors.New("missing destination folder\n\n" + getHelpExportOpenSSL())
+	}
+
+	var entries []*indexEntry
+	// Serial numbers are only unique per CA, the revocations are indexed by CA name and serial number
+	var revoked map[string]*Revocation = make(map[string]*Revocation)
+
+	for issuer, revocations := range (*state).Revocations {
+		for _, revocation := range revocations {
+			revoked[issuer + ":" + (*revocation).SerialNumber] = revocation
+		}
+	}
+
+	// Certificates still in the repository
+	for _, elements := range []map[string]*Element{(*state).Root, (*state).Intermediates, (*state).Clients} {
+		for _, el := range elements {
+			if (*el).SerialNumber == "" {
+				// Not signed yet
+				continue
+			}
+
+			_, cert, err := loadCertificate((*el).Path)
+			if err != nil {
+				return "", err
+			}
+
+			var entry *indexEntry = &indexEntry{
+				Status: "V",
+				ValidUntil: cert.NotAfter,
+				SerialNumber: cert.SerialNumber,
+				Subject: formatDN(cert),
+			}
+
+			// Certificates issued outside of the repository have no issuer name, so no revocation either
+			issuer, _ := getIssuerName(state, cert)
+
+			if revocation, ok := revoked[issuer + ":" + cert.SerialNumber.String()]; ok {
+				(*entry).Status = "R"
+				(*entry).RevokedOn = (*revocation).RevokedOn
+				(*entry).Reason = (*revocation).Reason
+
+				delete(revoked, issuer + ":" + cert.SerialNumber.String())
+			} else if cert.NotAfter.Before(time.Now()) {
+				(*entry).Status = "E"
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	// Revoked certificates which are not in the repository anymore
+	for _, revocation := range revoked {
+		serial, ok := new(big.Int).SetString((*revocation).SerialNumber, 10)
+		if !ok {
+			return "", errors.New("invalid serial number " + (*revocation).SerialNumber + " in the state")
+		}
+
+		var subject string = (*revocation).Subject
+		if subject == "" {
+			subject = "/CN=" + (*revocation).Name
+		}
+
+		entries = append(entries, &indexEntry{
+			Status: "R",
+			ValidUntil: (*revocation).ValidUntil,
+			RevokedOn: (*revocation).RevokedOn,
+			Reason: (*revocation).Reason,
+			SerialNumber: serial,
+			Subject: subject,
+		})
+	}
+
+	// OpenSSL does not care about the order but keep the file stable
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SerialNumber.Cmp(entries[j].SerialNumber) < 0
+	})
+
+	// The serial file contains the next serial number to use
+	var nextSerial *big.Int = big.NewInt(1)
+	var index strings.Builder
+
+	for _, entry := range entries {
+		index.WriteString(entry.String() + "\n")
+
+		if entry.SerialNumber.Cmp(nextSerial) >= 0 {
+			nextSerial = new(big.Int).Add(entry.SerialNumber, big.NewInt(1))
+		}
+	}
+
+	err = os.MkdirAll(folder, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(filepath.Join(folder, "index.txt"), []byte(index.String()), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(filepath.Join(folder, "serial"), []byte(formatSerialHex(nextSerial) + "\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return "OpenSSL CA database with " + strconv.Itoa(len(entries)) + " certificates written in " + folder, nil
+}
+
+
+func importOpenSSL(state *State, folder string, pass *passphraseSource) (string, error) {
+	var err error
+
+	if folder == "" {
+		return "", errors.New("missing OpenSSL CA folder\n\n" + getHelpImportOpenSSL())
+	}
+
+	var caCertPath string = filepath.Join(folder, "cacert.pem")
+	var caKeyPath string = filepath.Join(folder, "private", "cakey.pem")
+
+	err = checkOpenSSL(folder)
+	if err != nil {
+		return "", err
+	}
+
+	// The CA key may have been kept elsewhere
+	if _, err = os.Stat(caKeyPath); os.IsNotExist(err) {
+		caKeyPath = ""
+	}
+
+	err = import_(state, "root", "root", caKeyPath, caCertPath, "", pass)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := readIndex(filepath.Join(folder, "index.txt"))
+	if err != nil {
+		return "", err
+	}
+
+	var imported, revoked int
+	var clients []string
+
+	for _, entry := range entries {
+		if entry.Status == "R" {
+			(*state).revoke("root", entry.revocation())
+			revoked++
+			continue
+		}
+
+		// "openssl ca" keeps a copy of all certificates it signs, named after their serial number
+		var certPath string = filepath.Join(folder, "newcerts", formatSerialHex(entry.SerialNumber) + ".pem")
+
+		if _, err = os.Stat(certPath); os.IsNotExist(err) {
+			fmt.Println("Warning: " + certPath + " does not exist, " + entry.Subject + " not imported")
+			continue
+		}
+
+		_, certs, err := readCertificates(certPath)
+		if err != nil {
+			return "", err
+		}
+
+		var class string = "client"
+		if certs[0].IsCA {
+			class = "intermediate"
+		}
+
+		// Several certificates may have been issued for the same name, and names which are not valid file names are
+		// replaced by the serial number
+		var name string = entry.commonName()
+		if checkName(name) != nil {
+			name = formatSerialHex(entry.SerialNumber)
+		} else if _, ok := (*state).get(class, name); ok {
+			name += "-" + formatSerialHex(entry.SerialNumber)
+		}
+
+		err = import_(state, class, name, "", certPath, "", nil)
+		if err != nil {
+			return "", errors.New("can't import " + certPath + ": " + err.Error())
+		}
+
+		if class == "client" {
+			clients = append(clients, name)
+		}
+
+		imported++
+	}
+
+	// The issuers of the clients may come after them in the database
+	for _, name := range clients {
+		err = writeFullChain(state, getPath("client", name))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "OpenSSL CA imported: " + strconv.Itoa(imported) + " certificates, " + strconv.Itoa(revoked) + " revocations", nil
+}
+
+
+// Read an OpenSSL CA database (index.txt)
+func readIndex(indexPath string) ([]*indexEntry, error) {
+	var entries []*indexEntry
+
+	content, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		entry, err := parseIndexEntry(strings.Split(scanner.Text(), "\t"))
+		if err != nil {
+			return nil, errors.New("invalid line in " + indexPath + ": " + err.Error())
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+
+func parseIndexEntry(fields []string) (*indexEntry, error) {
+	var err error
+	var ok bool
+
+	if len(fields) != 6 {
+		return nil, errors.New("expected 6 fields, got " + strconv.Itoa(len(fields)))
+	}
+
+	var entry *indexEntry = &indexEntry{Status: fields[0], Subject: fields[5]}
+
+	switch fields[0] {
+	case "V", "E":
+	case "R":
+		var revocationField []string = strings.SplitN(fields[2], ",", 2)
+
+		(*entry).RevokedOn, err = parseIndexTime(revocationField[0])
+		if err != nil {
+			return nil, err
+		}
+
+		(*entry).Reason = "unspecified"
+		if len(revocationField) == 2 {
+			(*entry).Reason = revocationField[1]
+		}
+	default:
+		return nil, errors.New("unknown status " + fields[0])
+	}
+
+	(*entry).ValidUntil, err = parseIndexTime(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	(*entry).SerialNumber, ok = newSerialFromHex(fields[3])
+	if !ok {
+		return nil, errors.New("invalid serial number " + fields[3])
+	}
+
+	return entry, nil
+}
+
+
+// OpenSSL CA databases store dates as UTCTime (YYMMDDHHMMSSZ) or GeneralizedTime (YYYYMMDDHHMMSSZ)
+func parseIndexTime(value string) (time.Time, error) {
+	if len(value) == len("060102150405Z") {
+		return time.Parse("060102150405Z", value)
+	}
+
+	return time.Parse("20060102150405Z", value)
+}
+
+func formatIndexTime(value time.Time) string {
+	// Same rule as for certificates (RFC 5280 section 4.1.2.5)
+	if value.UTC().Year() < 2050 {
+		return value.UTC().Format("060102150405Z")
+	}
+
+	return value.UTC().Format("20060102150405Z")
+}
+
+
+// OpenSSL writes serial numbers in upper case hexadecimal, with an even number of digits
+func formatSerialHex(serial *big.Int) string {
+	var hex string = strings.ToUpper(serial.Text(16))
+
+	if len(hex) % 2 == 1 {
+		hex = "0" + hex
+	}
+
+	return hex
+}
+
+
+var dnShortNames map[string]string = map[string]string{
+	"2.5.4.3": "CN",
+	"2.5.4.5": "serialNumber",
+	"2.5.4.6": "C",
+	"2.5.4.7": "L",
+	"2.5.4.8": "ST",
+	"2.5.4.9": "street",
+	"2.5.4.10": "O",
+	"2.5.4.11": "OU",
+	"2.5.4.17": "postalCode",
+	"1.2.840.113549.1.9.1": "emailAddress",
+	"0.9.2342.19200300.100.1.1": "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+}
+
+// Format the certificate subject the way OpenSSL does in its database (/C=FR/O=Organization/CN=name), in the order of
+// the certificate
+func formatDN(cert *x509.Certificate) string {
+	var rdns pkix.RDNSequence
+	var dn string
+
+	if _, err := asn1.Unmarshal(cert.RawSubject, &rdns); err != nil {
+		rdns = cert.Subject.ToRDNSequence()
+	}
+
+	for _, rdn := range rdns {
+		for _, atv := range rdn {
+			name, ok := dnShortNames[atv.Type.String()]
+			if !ok {
+				name = atv.Type.String()
+			}
+
+			dn += "/" + name + "=" + fmt.Sprint(atv.Value)
+		}
+	}
+
+	return dn
+}
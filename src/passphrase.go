@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+
+// If set, this program is called (with the prompt as only argument) instead of prompting on the terminal. Programs
+// named pinentry* are driven with the Assuan protocol.
+const askpassEnv = "SIMPLECA_ASKPASS"
+
+
+// Where to read a passphrase from. A nil or empty source prompts the user.
+type passphraseSource struct {
+	File string
+	Env string
+	Fd int
+
+	// Non interactive sources are read only once
+	value *string
+}
+
+
+// Register the flags of the passphrase source, with the given prefix (e.g. "with-" for the CA key in `sign`)
+func (p *passphraseSource) addFlags(commands *flag.FlagSet, prefix string) {
+	commands.StringVar(&p.File, prefix + "passphrase-file", "", "")
+	commands.StringVar(&p.Env, prefix + "passphrase-env", "", "")
+	commands.IntVar(&p.Fd, prefix + "passphrase-fd", -1, "")
+}
+
+
+// The help of the flags registered by addFlags
+func getHelpPassphrase(prefix, what string) string {
+	return `--` + prefix + `passphrase-file string
+	(optional) Read the passphrase of ` + what + ` from the first line of this file instead of prompting for it.
+
+--` + prefix + `passphrase-env string
+	(optional) Read the passphrase of ` + what + ` from this environment variable.
+
+--` + prefix + `passphrase-fd int
+	(optional) Read the passphrase of ` + what + ` from the first line read on this file descriptor.`
+}
+
+
+func getHelpAskpass() string {
+	return `If the ` + askpassEnv + ` environment variable is set, the program it points to is used to ask for passphrases
+instead of the terminal (like ssh-askpass: the prompt is given as argument and the passphrase is read on its output).
+pinentry programs are supported as well.`
+}
+
+
+func (p *passphraseSource) isInteractive() bool {
+	return p == nil || (p.File == "" && p.Env == "" && p.Fd < 0)
+}
+
+
+// Return the passphrase, asking for it with the given prompt if the source is interactive
+func (p *passphraseSource) read(prompt string) (string, error) {
+	if p.isInteractive() {
+		return getpass(prompt)
+	}
+
+	if p.value != nil {
+		return *p.value, nil
+	}
+
+	var value string
+
+	switch {
+	case p.File != "":
+		content, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return "", err
+		}
+		value = firstLine(string(content))
+	case p.Env != "":
+		var ok bool
+
+		value, ok = os.LookupEnv(p.Env)
+		if !ok {
+			return "", errors.New("the environment variable " + p.Env + " is not set")
+		}
+	default:
+		f := os.NewFile(uintptr(p.Fd), "fd" + strconv.Itoa(p.Fd))
+		if f == nil {
+			return "", errors.New("invalid file descriptor " + strconv.Itoa(p.Fd))
+		}
+
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("can't read the passphrase from file descriptor " + strconv.Itoa(p.Fd) + ": " + err.Error())
+		}
+		value = firstLine(line)
+	}
+
+	p.value = &value
+
+	return value, nil
+}
+
+
+func firstLine(content string) string {
+	return strings.TrimRight(strings.SplitN(content, "\n", 2)[0], "\r")
+}
+
+
+// Shared by all prompts so no buffered input is lost between two of them
+var stdinReader *bufio.Reader = bufio.NewReader(os.Stdin)
+
+
+// Thank you go for not providing a getpass() equivalent in the stdlib
+func getpass(prompt string) (string, error) {
+	if program := os.Getenv(askpassEnv); program != "" {
+		if strings.HasPrefix(filepath.Base(program), "pinentry") {
+			return pinentry(program, prompt)
+		}
+		return askpass(program, prompt)
+	}
+
+	// Print the prompt if needed
+	if prompt != "" {
+		fmt.Print(prompt)
+	}
+
+	// Disable echo if stdin is a terminal (if it's not, we're probably fed by a pipe)
+	restore, err := disableEcho(os.Stdin.Fd())
+	if err == nil {
+		defer restore()
+	}
+
+	text, err := stdinReader.ReadString('\n')
+
+	// Print the carriage return that has been swallowed
+	fmt.Println()
+
+	if err != nil && text == "" {
+		return "", err
+	}
+
+	return strings.TrimSpace(text), nil
+}
+
+
+// Call an askpass program (as ssh-askpass does): the prompt is the first argument, the passphrase is written on stdout
+func askpass(program, prompt string) (string, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(program, prompt)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.New(program + " failed: " + strings.TrimSpace(stderr.String() + " " + err.Error()))
+	}
+
+	return firstLine(string(output)), nil
+}
+
+
+// Ask the passphrase with a pinentry program, using the Assuan protocol
+func pinentry(program, prompt string) (string, error) {
+	cmd := exec.Command(program)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		stdin.Close()
+		return "", err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	// pinentry waits for commands until its input is closed, even after an error
+	defer func() {
+		fmt.Fprintln(stdin, "BYE")
+		stdin.Close()
+		cmd.Wait()
+	}()
+
+	reader := bufio.NewReader(stdout)
+
+	// Read responses until OK or ERR, return the data lines
+	var readResponse = func() (string, error) {
+		var data string
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return "", errors.New(program + " stopped unexpectedly")
+			}
+			line = strings.TrimRight(line, "\n")
+
+			switch {
+			case line == "OK" || strings.HasPrefix(line, "OK "):
+				return data, nil
+			case strings.HasPrefix(line, "ERR"):
+				return "", errors.New(program + ": " + line)
+			case strings.HasPrefix(line, "D "):
+				// Data is percent-encoded
+				decoded, err := url.PathUnescape(strings.TrimPrefix(line, "D "))
+				if err != nil {
+					return "", err
+				}
+				data += decoded
+			}
+		}
+	}
+
+	// Greeting
+	if _, err = readResponse(); err != nil {
+		return "", err
+	}
+
+	var escapedPrompt string = strings.NewReplacer("%", "%25", "\n", "%0A", "\r", "%0D").Replace(prompt)
+
+	for _, command := range []string{"SETTITLE simpleca", "SETDESC " + escapedPrompt, "SETPROMPT Passphrase:"} {
+		fmt.Fprintln(stdin, command)
+
+		if _, err = readResponse(); err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Fprintln(stdin, "GETPIN")
+
+	passphrase, err := readResponse()
+	if err != nil {
+		return "", err
+	}
+
+	return passphrase, nil
+}
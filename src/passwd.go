@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+
+func getHelpPasswd() string {
+	return `Usage: simpleca passwd <class> [--name=<name>] [--encrypt | --decrypt]
+
+Change the password of a private key. The key is rewritten in place.
+
+Available classes:
+	root           change the root CA key password
+	intermediate   change an intermediate CA key password
+	client         change a client key password
+
+--name string
+	(optional) The key name.
+
+--encrypt
+	(optional) Encrypt a private key which has been generated with --clear-text.
+
+--decrypt
+	(optional) Remove the password of a private key and store it in clear text. This is not recommended.
+
+` + getHelpPassphrase("", "the key (its current one)") + `
+
+` + getHelpPassphrase("new-", "the key (the new one)") + `
+
+` + getHelpAskpass()
+}
+
+
+func passwd(state *State, class, keyName string, encrypt, decrypt bool, pass, newPass *passphraseSource) error {
+	var err error
+
+	if encrypt && decrypt {
+		return errors.New("--encrypt and --decrypt can't be used together")
+	}
+
+	switch class {
+	case "root":
+		if keyName == "" {
+			keyName = "root"
+		}
+	case "intermediate":
+		if keyName == "" {
+			keyName = "intermediate"
+		}
+	case "client":
+		if keyName == "" {
+			keyName = "client"
+		}
+	default:
+		return errors.New("can't change the password of a " + class)
+	}
+
+	var keyInState *Element
+	var ok bool
+
+	keyInState, ok = (*state).get(class, keyName)
+	if !ok {
+		return errors.New("key " + keyName + " is not known")
+	}
+
+	var privKeyPath string = getPrivKeyPath((*keyInState).Path)
+
+	privKeyPem, err := readPrivKey((*keyInState).Path)
+	if err != nil {
+		return err
+	}
+
+	var encrypted bool = privKeyPem.Type == EncryptedPrivKeyHeader || x509.IsEncryptedPEMBlock(privKeyPem)
+
+	if encrypt && encrypted {
+		return errors.New("the private key " + privKeyPath + " is already encrypted")
+	}
+	if !encrypt && !encrypted {
+		return errors.New("the private key " + privKeyPath + " is not encrypted, use --encrypt to add a password")
+	}
+
+	privKey, _, err := unlockPrivKey((*keyInState).Type, (*keyInState).Path, pass)
+	if err != nil {
+		return err
+	}
+
+	var password string
+
+	if !decrypt {
+		password, err = askNewPassword(privKeyPath, newPass)
+		if err != nil {
+			return err
+		}
+	}
+
+	newPrivKeyPem, err := encodePrivKey(privKey, password, decrypt)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(privKeyPath, pem.EncodeToMemory(newPrivKeyPem), 0600)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case decrypt:
+		fmt.Println("Password removed from " + privKeyPath)
+	case encrypt:
+		fmt.Println("Private key " + privKeyPath + " encrypted")
+	default:
+		fmt.Println("Password of " + privKeyPath + " changed")
+	}
+
+	return nil
+}
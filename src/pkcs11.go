@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PKCS#11 tokens are driven through the pkcs11-tool command of OpenSC: this keeps simpleca a static binary (no cgo) and
+// any token supported by OpenSC (SoftHSM, YubiHSM, smart cards...) can be used.
+const pkcs11Tool = "pkcs11-tool"
+
+// The PIN is given to pkcs11-tool through this environment variable, so it does not appear in the process list
+const pkcs11PinEnv = "SIMPLECA_PKCS11_PIN"
+
+
+// A PKCS#11 URI (RFC 7512), only the attributes simpleca needs are kept:
+// pkcs11:token=<label>;slot-id=<id>;object=<label>?module-path=<path>&pin-source=file:<path>
+type pkcs11URI struct {
+	Module string
+	Token string
+	Slot string
+	Object string
+	PinValue string
+	PinSource string
+}
+
+
+func parsePKCS11URI(value string) (*pkcs11URI, error) {
+	var uri pkcs11URI
+
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Scheme != "pkcs11" {
+		return nil, errors.New(value + " is not a PKCS#11 URI (it must start with \"pkcs11:\")")
+	}
+
+	for _, attribute := range strings.Split(parsed.Opaque, ";") {
+		if attribute == "" {
+			continue
+		}
+
+		var parts []string = strings.SplitN(attribute, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid attribute " + attribute + " in PKCS#11 URI")
+		}
+
+		attrValue, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		switch parts[0] {
+		case "token":
+			uri.Token = attrValue
+		case "slot-id":
+			uri.Slot = attrValue
+		case "object":
+			uri.Object = attrValue
+		}
+	}
+
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	uri.Module = query.Get("module-path")
+	uri.PinValue = query.Get("pin-value")
+	uri.PinSource = query.Get("pin-source")
+
+	if uri.Object == "" {
+		return nil, errors.New("the PKCS#11 URI " + value + " must contain the object (key label)")
+	}
+
+	return &uri, nil
+}
+
+
+// The arguments selecting the module, the token and the key
+func (u *pkcs11URI) args() []string {
+	var args []string
+
+	if u.Module != "" {
+		args = append(args, "--module", u.Module)
+	}
+	if u.Slot != "" {
+		args = append(args, "--slot", u.Slot)
+	}
+	if u.Token != "" {
+		args = append(args, "--token-label", u.Token)
+	}
+
+	args = append(args, "--login", "--pin", "env:" + pkcs11PinEnv, "--label", u.Object)
+
+	return args
+}
+
+
+// Return the user PIN of the token, from the URI or asking for it
+func (u *pkcs11URI) getPin(pass *passphraseSource) (string, error) {
+	if u.PinValue != "" {
+		return u.PinValue, nil
+	}
+
+	if u.PinSource != "" {
+		content, err := ioutil.ReadFile(strings.TrimPrefix(u.PinSource, "file:"))
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	var token string = u.Token
+	if token == "" {
+		token = "slot " + u.Slot
+	}
+
+	return pass.read("Please enter the PIN of the PKCS#11 token " + token + ": ")
+}
+
+
+// The state is readable by everyone: the PIN given in the URI is only used to generate the key, it is not stored
+func removePinValue(value string) string {
+	var parts []string = strings.SplitN(value, "?", 2)
+	if len(parts) != 2 {
+		return value
+	}
+
+	var attributes []string
+	for _, attribute := range strings.Split(parts[1], "&") {
+		if !strings.HasPrefix(attribute, "pin-value=") {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	if len(attributes) == 0 {
+		return parts[0]
+	}
+
+	return parts[0] + "?" + strings.Join(attributes, "&")
+}
+
+
+func runPKCS11Tool(pin string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(pkcs11Tool, args...)
+	cmd.Env = append(os.Environ(), pkcs11PinEnv + "=" + pin)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.Error); ok {
+			return nil, errors.New(pkcs11Tool + " (from OpenSC) is needed to use PKCS#11 tokens: " + err.Error())
+		}
+		return nil, errors.New(pkcs11Tool + " failed: " + strings.TrimSpace(stderr.String()))
+	}
+
+	return output, nil
+}
+
+
+// Run pkcs11-tool with an input file and return the content of the output file
+func runPKCS11ToolWithFiles(pin string, input []byte, args ...string) ([]byte, error) {
+	tmpDir, err := ioutil.TempDir("", "simpleca")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var inputPath string = tmpDir + "/input"
+	var outputPath string = tmpDir + "/output"
+
+	if input != nil {
+		err = ioutil.WriteFile(inputPath, input, 0600)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--input-file", inputPath)
+	}
+
+	args = append(args, "--output-file", outputPath)
+
+	_, err = runPKCS11Tool(pin, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(outputPath)
+}
+
+
+// A crypto.Signer whose private key never leaves the PKCS#11 token
+type pkcs11Signer struct {
+	uri *pkcs11URI
+	pin string
+	pubKey crypto.PublicKey
+}
+
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.pubKey
+}
+
+
+// DigestInfo prefixes for PKCS#1 v1.5 signatures (RFC 8017 section 9.2), the token only pads the data
+var pkcs1DigestInfoPrefixes map[crypto.Hash][]byte = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var args []string = s.uri.args()
+
+	switch s.pubKey.(type) {
+	case *ecdsa.PublicKey:
+		// Go expects an ASN.1 signature, not the raw r|s PKCS#11 returns
+		return runPKCS11ToolWithFiles(s.pin, digest, append(args, "--sign", "--mechanism", "ECDSA", "--signature-format", "openssl")...)
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("RSA-PSS signatures are not supported with PKCS#11 tokens")
+		}
+
+		prefix, ok := pkcs1DigestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, errors.New("unsupported hash function for PKCS#11 RSA signatures")
+		}
+
+		return runPKCS11ToolWithFiles(s.pin, append(append([]byte{}, prefix...), digest...), append(args, "--sign", "--mechanism", "RSA-PKCS")...)
+	default:
+		return nil, errors.New("only ECDSA and RSA keys are supported on PKCS#11 tokens")
+	}
+}
+
+
+// Return a signer using the key stored on the token the element points to
+func loadPKCS11Signer(el *Element, pass *passphraseSource) (crypto.Signer, error) {
+	uri, err := parsePKCS11URI((*el).PKCS11)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := loadPubKey((*el).Path)
+	if err != nil {
+		return nil, err
+	}
+
+	pin, err := uri.getPin(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkcs11Signer{uri: uri, pin: pin, pubKey: pubKey}, nil
+}
+
+
+// Generate a key pair on the PKCS#11 token instead of on disk, only its public key is written in the repository
+func generatePKCS11(state *State, class string, keySize int, keyType, keyName, pkcs11 string, pass *passphraseSource) error {
+	var err error
+	var keySpec string
+
+	switch class {
+	case "root":
+		keyName = "root"
+	case "intermediate":
+		if keyName == "" {
+			keyName = "intermediate"
+		}
+	default:
+		return errors.New("only CA keys (root and intermediate) can be generated on a PKCS#11 token")
+	}
+
+	err = checkName(keyName)
+	if err != nil {
+		return err
+	}
+
+	switch keyType {
+	case "rsa":
+		if keySize == 0 {
+			keySize = 2048
+		}
+		keySpec = "rsa:" + strconv.Itoa(keySize)
+	case "ecdsa":
+		if keySize == 0 {
+			keySize = 384
+		}
+
+		switch keySize {
+		case 256:
+			keySpec = "EC:prime256v1"
+		case 384:
+			keySpec = "EC:secp384r1"
+		case 521:
+			keySpec = "EC:secp521r1"
+		default:
+			return errors.New(strconv.Itoa(keySize) + " bits keys size are not available on PKCS#11 tokens")
+		}
+	default:
+		return errors.New("key type " + keyType + " is not available on PKCS#11 tokens")
+	}
+
+	uri, err := parsePKCS11URI(pkcs11)
+	if err != nil {
+		return err
+	}
+
+	pin, err := uri.getPin(pass)
+	if err != nil {
+		return err
+	}
+
+	// pkcs11-tool would happily create a second key with the same label, and the key used to sign would then depend on
+	// the token
+	objects, err := runPKCS11Tool(pin, append(uri.args(), "--list-objects")...)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(objects)) != "" {
+		return errors.New("the PKCS#11 token already contains an object labelled " + uri.Object + ", choose another object in the URI or delete it first")
+	}
+
+	_, err = runPKCS11Tool(pin, append(uri.args(), "--keypairgen", "--key-type", keySpec, "--usage-sign")...)
+	if err != nil {
+		return err
+	}
+
+	// Retrieve the public key (DER encoded SubjectPublicKeyInfo)
+	pubKeyDer, err := runPKCS11ToolWithFiles(pin, nil, append(uri.args(), "--read-object", "--type", "pubkey")...)
+	if err != nil {
+		return err
+	}
+
+	pubKey, err := x509.ParsePKIXPublicKey(pubKeyDer)
+	if err != nil {
+		return errors.New("can't read the public key from the token: " + err.Error())
+	}
+
+	pubKeyPem, err := encodePubKey(pubKey)
+	if err != nil {
+		return err
+	}
+
+	var path string = getPath(class, keyName)
+
+	err = writeFileAtomic(getPubKeyPath(path), pem.EncodeToMemory(pubKeyPem), 0644)
+	if err != nil {
+		return err
+	}
+
+	(*state).set(class, keyName, &Element{
+		Path: path,
+		Type: keyType,
+		Size: keySize,
+		CreatedOn: time.Now(),
+		ValidUntil: time.Now(),
+		PKCS11: removePinValue(pkcs11),
+	})
+
+	fmt.Println("Key generated on the PKCS#11 token, public key available in " + getPubKeyPath(path))
+
+	return nil
+}
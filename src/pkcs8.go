@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"strconv"
+)
+
+
+// PEM header of PKCS#8 encrypted private keys (RFC 5958)
+const EncryptedPrivKeyHeader = "ENCRYPTED PRIVATE KEY"
+
+// Number of PBKDF2 rounds used when encrypting new keys
+const pbkdf2Iterations = 600000
+
+// Keys using more PBKDF2 rounds are refused, a corrupted key file could make simpleca hang otherwise
+const pbkdf2MaxIterations = 10000000
+
+
+var (
+	oidPBES2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+
+	oidHMACWithSHA1 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+
+type encryptedPrivateKeyInfo struct {
+	EncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt []byte
+	IterationCount int
+	KeyLength int `asn1:"optional"`
+	PRF pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+
+// Encrypt a DER-encoded PKCS#8 private key with PBES2 (PBKDF2-HMAC-SHA256 and AES-256-CBC)
+func encryptPKCS8(privKeyPKCS8 []byte, password []byte) (*pem.Block, error) {
+	var err error
+
+	var salt []byte = make([]byte, 16)
+	var iv []byte = make([]byte, aes.BlockSize)
+
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	var key []byte = pbkdf2(sha256.New, password, salt, pbkdf2Iterations, 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// PKCS#7 padding
+	var padding int = aes.BlockSize - len(privKeyPKCS8) % aes.BlockSize
+	var encrypted []byte = make([]byte, len(privKeyPKCS8) + padding)
+	copy(encrypted, privKeyPKCS8)
+	for i := len(privKeyPKCS8); i < len(encrypted); i++ {
+		encrypted[i] = byte(padding)
+	}
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt: salt,
+		IterationCount: pbkdf2Iterations,
+		PRF: pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParams}},
+		EncryptionScheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParams}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		EncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: encrypted,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pem.Block{Type: EncryptedPrivKeyHeader, Bytes: der}, nil
+}
+
+
+// Decrypt a PKCS#8 "ENCRYPTED PRIVATE KEY" block and return the DER-encoded PKCS#8 private key
+func decryptPKCS8(privKeyPem *pem.Block, password []byte) ([]byte, error) {
+	var err error
+
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdfParams pbkdf2Params
+	var iv []byte
+
+	if _, err = asn1.Unmarshal(privKeyPem.Bytes, &info); err != nil {
+		return nil, errors.New("invalid encrypted private key: " + err.Error())
+	}
+
+	if !info.EncryptionAlgorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("only PBES2 encrypted private keys are supported")
+	}
+
+	if _, err = asn1.Unmarshal(info.EncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("invalid PBES2 parameters: " + err.Error())
+	}
+
+	// Key derivation
+	switch {
+	case params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2):
+	case params.KeyDerivationFunc.Algorithm.Equal(oidScrypt):
+		return nil, errors.New("scrypt encrypted private keys are not supported, please re-encrypt it with PBKDF2")
+	default:
+		return nil, errors.New("unsupported key derivation function " + params.KeyDerivationFunc.Algorithm.String())
+	}
+
+	if _, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errors.New("invalid PBKDF2 parameters: " + err.Error())
+	}
+
+	if kdfParams.IterationCount <= 0 || kdfParams.IterationCount > pbkdf2MaxIterations {
+		return nil, errors.New("invalid PBKDF2 iteration count " + strconv.Itoa(kdfParams.IterationCount) + " (at most " + strconv.Itoa(pbkdf2MaxIterations) + ")")
+	}
+
+	var prf func() hash.Hash
+
+	switch {
+	case len(kdfParams.PRF.Algorithm) == 0, kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdfParams.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, errors.New("unsupported PBKDF2 pseudo-random function " + kdfParams.PRF.Algorithm.String())
+	}
+
+	// Encryption scheme
+	var keyLength int
+
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLength = 32
+	default:
+		return nil, errors.New("unsupported encryption scheme " + params.EncryptionScheme.Algorithm.String())
+	}
+
+	if _, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES initialization vector")
+	}
+
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData) % aes.BlockSize != 0 {
+		return nil, errors.New("invalid encrypted private key length")
+	}
+
+	var key []byte = pbkdf2(prf, password, kdfParams.Salt, kdfParams.IterationCount, keyLength)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var decrypted []byte = make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+
+	// Remove the PKCS#7 padding (a bad padding almost always means a wrong password)
+	var padding int = int(decrypted[len(decrypted) - 1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("decryption failed, the password is probably wrong")
+	}
+	for _, b := range decrypted[len(decrypted) - padding:] {
+		if int(b) != padding {
+			return nil, errors.New("decryption failed, the password is probably wrong")
+		}
+	}
+
+	return decrypted[:len(decrypted) - padding], nil
+}
+
+
+// PBKDF2 as described in RFC 8018 section 5.2
+func pbkdf2(prf func() hash.Hash, password, salt []byte, iterations, keyLength int) []byte {
+	mac := hmac.New(prf, password)
+
+	var hashLength int = mac.Size()
+	var blocks int = (keyLength + hashLength - 1) / hashLength
+
+	var derived []byte = make([]byte, 0, blocks * hashLength)
+	var counter []byte = make([]byte, 4)
+	var u []byte = make([]byte, hashLength)
+	var t []byte = make([]byte, hashLength)
+
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(counter, uint32(block))
+
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(counter)
+		u = mac.Sum(u[:0])
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		derived = append(derived, t...)
+	}
+
+	return derived[:keyLength]
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+
+// A custom extension, with either a DER or a UTF8String value
+type Extension struct {
+	OID string
+	Critical bool
+	// The DER encoded value, in hexadecimal
+	DER string `json:",omitempty"`
+	// A string, encoded as UTF8String
+	UTF8 string `json:",omitempty"`
+}
+
+
+var oidCertificatePolicies asn1.ObjectIdentifier = asn1.ObjectIdentifier{2, 5, 29, 32}
+var oidPolicyConstraints asn1.ObjectIdentifier = asn1.ObjectIdentifier{2, 5, 29, 36}
+var oidInhibitAnyPolicy asn1.ObjectIdentifier = asn1.ObjectIdentifier{2, 5, 29, 54}
+
+// The extensions simpleca (or crypto/x509) sets itself, a custom extension would end up twice in the certificate
+var reservedExtensions map[string]string = map[string]string{
+	"2.5.29.14": "subjectKeyIdentifier",
+	"2.5.29.15": "keyUsage",
+	"2.5.29.17": "subjectAltName",
+	"2.5.29.19": "basicConstraints",
+	"2.5.29.30": "nameConstraints",
+	"2.5.29.31": "cRLDistributionPoints",
+	"2.5.29.32": "certificatePolicies",
+	"2.5.29.35": "authorityKeyIdentifier",
+	"2.5.29.36": "policyConstraints",
+	"2.5.29.37": "extKeyUsage",
+	"2.5.29.46": "freshestCRL",
+	"2.5.29.54": "inhibitAnyPolicy",
+	"1.3.6.1.5.5.7.1.1": "authorityInfoAccess",
+	"1.3.6.1.5.5.7.48.1.5": "id-pkix-ocsp-nocheck",
+}
+
+
+// The flags adding policies and extensions to the ones of the profile
+type policyFlags struct {
+	policies, extensions stringArray
+	requireExplicitPolicy, inhibitPolicyMapping, inhibitAnyPolicy int
+}
+
+
+func (f *policyFlags) addFlags(commands *flag.FlagSet) {
+	commands.Var(&f.policies, "policy", "")
+	commands.Var(&f.extensions, "extension", "")
+	commands.IntVar(&f.requireExplicitPolicy, "require-explicit-policy", -1, "")
+	commands.IntVar(&f.inhibitPolicyMapping, "inhibit-policy-mapping", -1, "")
+	commands.IntVar(&f.inhibitAnyPolicy, "inhibit-any-policy", -1, "")
+}
+
+
+// The help of the flags registered by addFlags
+func getHelpPolicies() string {
+	return `--policy string
+	(optional) The OID of a certificate policy (2.5.29.32.0 for anyPolicy). You can provide this parameter multiple
+	times.
+
+--require-explicit-policy, --inhibit-policy-mapping, --inhibit-any-policy int
+	(optional, CA only) How many certificates can follow this CA in a chain before a policy is required, before policy
+	mapping is forbidden, or before anyPolicy stops matching every policy.
+
+--extension string
+	(optional) A custom extension, as <oid>=[critical,]utf8:<string> or <oid>=[critical,]der:<hexadecimal DER value>.
+	You can provide this parameter multiple times, once per OID. The extensions set by simpleca (key usages,
+	alternative names, policies, URLs...) can't be given this way.`
+}
+
+
+// Return a copy of the profile with the policies and extensions of the flags added
+func (f *policyFlags) apply(profile *Profile) (*Profile, error) {
+	var merged Profile = *profile
+
+	merged.Policies = append(append([]string{}, (*profile).Policies...), f.policies...)
+
+	for _, value := range []struct{flag int; field **int}{
+		{f.requireExplicitPolicy, &merged.RequireExplicitPolicy},
+		{f.inhibitPolicyMapping, &merged.InhibitPolicyMapping},
+		{f.inhibitAnyPolicy, &merged.InhibitAnyPolicy},
+	} {
+		if value.flag >= 0 {
+			var skipCerts int = value.flag
+			*value.field = &skipCerts
+		}
+	}
+
+	merged.Extensions = append([]*Extension{}, (*profile).Extensions...)
+	for _, extension := range f.extensions {
+		parsed, err := parseExtension(extension)
+		if err != nil {
+			return nil, err
+		}
+
+		merged.Extensions = append(merged.Extensions, parsed)
+	}
+
+	// Check the extensions of the profile too, before anything is signed
+	var seen map[string]bool = make(map[string]bool)
+
+	for _, extension := range merged.Extensions {
+		oid, err := parseOID((*extension).OID)
+		if err != nil {
+			return nil, err
+		}
+
+		if name, ok := reservedExtensions[oid.String()]; ok {
+			return nil, errors.New("the extension " + oid.String() + " (" + name + ") is set by simpleca, it can't be given as a custom extension")
+		}
+
+		if seen[oid.String()] {
+			return nil, errors.New("the extension " + oid.String() + " is given more than once")
+		}
+		seen[oid.String()] = true
+	}
+
+	return &merged, nil
+}
+
+
+// Parse <oid>=[critical,]utf8:<string> or <oid>=[critical,]der:<hexadecimal>
+func parseExtension(value string) (*Extension, error) {
+	var invalid error = errors.New("invalid extension " + value + " (expected <oid>=[critical,]utf8:<string> or <oid>=[critical,]der:<hexadecimal>)")
+
+	var parts []string = strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+
+	var extension *Extension = &Extension{OID: parts[0]}
+
+	if strings.HasPrefix(parts[1], "critical,") {
+		extension.Critical = true
+		parts[1] = strings.TrimPrefix(parts[1], "critical,")
+	}
+
+	switch {
+	case strings.HasPrefix(parts[1], "utf8:"):
+		extension.UTF8 = strings.TrimPrefix(parts[1], "utf8:")
+	case strings.HasPrefix(parts[1], "der:"):
+		extension.DER = strings.TrimPrefix(parts[1], "der:")
+	default:
+		return nil, invalid
+	}
+
+	return extension, nil
+}
+
+
+// Add the certificate policies, policy constraints and custom extensions of the profile to the certificate. They are
+// encoded here as crypto/x509 does not support all of them.
+func setPolicies(cert *x509.Certificate, profile *Profile) error {
+	if !(*profile).CA && ((*profile).RequireExplicitPolicy != nil || (*profile).InhibitPolicyMapping != nil || (*profile).InhibitAnyPolicy != nil) {
+		return errors.New("policy constraints and inhibitAnyPolicy can only be set on CAs")
+	}
+
+	if len((*profile).Policies) > 0 {
+		var policies []struct{ Policy asn1.ObjectIdentifier }
+
+		for _, policy := range (*profile).Policies {
+			oid, err := parseOID(policy)
+			if err != nil {
+				return err
+			}
+			policies = append(policies, struct{ Policy asn1.ObjectIdentifier }{oid})
+		}
+
+		value, err := asn1.Marshal(policies)
+		if err != nil {
+			return err
+		}
+
+		cert.ExtraExtensions = append(cert.ExtraExtensions, pkix.Extension{Id: oidCertificatePolicies, Value: value})
+	}
+
+	// RFC 5280 requires both extensions to be critical
+	if (*profile).RequireExplicitPolicy != nil || (*profile).InhibitPolicyMapping != nil {
+		var constraints []asn1.RawValue
+
+		for tag, skipCerts := range []*int{(*profile).RequireExplicitPolicy, (*profile).InhibitPolicyMapping} {
+			if skipCerts == nil {
+				continue
+			}
+
+			integer, err := marshalSkipCerts(*skipCerts)
+			if err != nil {
+				return err
+			}
+			constraints = append(constraints, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, Bytes: integer.Bytes})
+		}
+
+		value, err := asn1.Marshal(constraints)
+		if err != nil {
+			return err
+		}
+
+		cert.ExtraExtensions = append(cert.ExtraExtensions, pkix.Extension{Id: oidPolicyConstraints, Critical: true, Value: value})
+	}
+
+	if (*profile).InhibitAnyPolicy != nil {
+		integer, err := marshalSkipCerts(*(*profile).InhibitAnyPolicy)
+		if err != nil {
+			return err
+		}
+
+		cert.ExtraExtensions = append(cert.ExtraExtensions, pkix.Extension{Id: oidInhibitAnyPolicy, Critical: true, Value: integer.FullBytes})
+	}
+
+	for _, extension := range (*profile).Extensions {
+		oid, err := parseOID((*extension).OID)
+		if err != nil {
+			return err
+		}
+
+		var value []byte
+
+		if (*extension).DER != "" {
+			value, err = hex.DecodeString((*extension).DER)
+			if err == nil {
+				var rest []byte
+				rest, err = asn1.Unmarshal(value, &asn1.RawValue{})
+				if err == nil && len(rest) > 0 {
+					err = errors.New("trailing data")
+				}
+			}
+			if err != nil {
+				return errors.New("invalid DER value of the extension " + (*extension).OID + ": " + err.Error())
+			}
+		} else {
+			value, err = asn1.MarshalWithParams((*extension).UTF8, "utf8")
+			if err != nil {
+				return err
+			}
+		}
+
+		cert.ExtraExtensions = append(cert.ExtraExtensions, pkix.Extension{Id: oid, Critical: (*extension).Critical, Value: value})
+	}
+
+	return nil
+}
+
+
+// The SkipCerts INTEGER of policy constraints and inhibitAnyPolicy
+func marshalSkipCerts(skipCerts int) (asn1.RawValue, error) {
+	var integer asn1.RawValue
+
+	if skipCerts < 0 {
+		return integer, errors.New("the number of certificates of policy constraints must be positive")
+	}
+
+	der, err := asn1.Marshal(skipCerts)
+	if err != nil {
+		return integer, err
+	}
+
+	_, err = asn1.Unmarshal(der, &integer)
+
+	return integer, err
+}
+
+
+// Parse an OID in its dotted form (1.2.3.4)
+func parseOID(value string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+
+	var components []string = strings.Split(value, ".")
+	if len(components) < 2 {
+		return nil, errors.New(value + " is not a valid OID")
+	}
+
+	for _, component := range components {
+		number, err := strconv.Atoi(component)
+		if err != nil || number < 0 {
+			return nil, errors.New(value + " is not a valid OID")
+		}
+		oid = append(oid, number)
+	}
+
+	return oid, nil
+}
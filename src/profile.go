@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// What a certificate can be used for, chosen with `sign --profile`
+type Profile struct {
+	// digitalSignature, contentCommitment, keyEncipherment, dataEncipherment, keyAgreement, certSign, crlSign
+	KeyUsage []string
+	// serverAuth, clientAuth, codeSigning, emailProtection, ocspSigning, timeStamping, any
+	ExtKeyUsage []string
+	// CA certificate (basic constraints)
+	CA bool
+	// Add the CommonName to the alternative names (it should be a host name, an IP or an email address then)
+	CommonNameAsSAN bool
+	// Add the id-pkix-ocsp-nocheck extension (RFC 6960), for OCSP responders
+	OCSPNoCheck bool
+	// Subject template of the certificates, as a RFC 4514 string (see Conf.Subjects)
+	Subject string `json:",omitempty"`
+	// OIDs of the certificate policies
+	Policies []string `json:",omitempty"`
+	// Policy constraints and inhibitAnyPolicy of CA certificates (how many certificates can follow in a chain)
+	RequireExplicitPolicy *int `json:",omitempty"`
+	InhibitPolicyMapping *int `json:",omitempty"`
+	InhibitAnyPolicy *int `json:",omitempty"`
+	// Custom extensions
+	Extensions []*Extension `json:",omitempty"`
+}
+
+
+var keyUsages map[string]x509.KeyUsage = map[string]x509.KeyUsage{
+	"digitalSignature": x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment": x509.KeyUsageKeyEncipherment,
+	"dataEncipherment": x509.KeyUsageDataEncipherment,
+	"keyAgreement": x509.KeyUsageKeyAgreement,
+	"certSign": x509.KeyUsageCertSign,
+	"crlSign": x509.KeyUsageCRLSign,
+}
+
+var extKeyUsages map[string]x509.ExtKeyUsage = map[string]x509.ExtKeyUsage{
+	"serverAuth": x509.ExtKeyUsageServerAuth,
+	"clientAuth": x509.ExtKeyUsageClientAuth,
+	"codeSigning": x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"ocspSigning": x509.ExtKeyUsageOCSPSigning,
+	"timeStamping": x509.ExtKeyUsageTimeStamping,
+	"any": x509.ExtKeyUsageAny,
+}
+
+var oidOCSPNoCheck asn1.ObjectIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+
+// The profiles available out of the box, the ones of the configuration file take precedence
+func getDefaultProfiles() map[string]*Profile {
+	return map[string]*Profile{
+		"server": &Profile{
+			KeyUsage: []string{"digitalSignature"},
+			ExtKeyUsage: []string{"serverAuth"},
+			CommonNameAsSAN: true,
+		},
+		"client": &Profile{
+			KeyUsage: []string{"digitalSignature"},
+			ExtKeyUsage: []string{"clientAuth"},
+			CommonNameAsSAN: true,
+		},
+		"mtls": &Profile{
+			KeyUsage: []string{"digitalSignature"},
+			ExtKeyUsage: []string{"serverAuth", "clientAuth"},
+			CommonNameAsSAN: true,
+		},
+		"code-signing": &Profile{
+			KeyUsage: []string{"digitalSignature"},
+			ExtKeyUsage: []string{"codeSigning"},
+		},
+		"email": &Profile{
+			KeyUsage: []string{"digitalSignature", "keyEncipherment"},
+			ExtKeyUsage: []string{"emailProtection"},
+		},
+		"ocsp-signing": &Profile{
+			KeyUsage: []string{"digitalSignature"},
+			ExtKeyUsage: []string{"ocspSigning"},
+			OCSPNoCheck: true,
+		},
+		"root-ca": &Profile{
+			KeyUsage: []string{"certSign", "crlSign"},
+			CA: true,
+		},
+		"sub-ca": &Profile{
+			KeyUsage: []string{"certSign", "crlSign"},
+			CA: true,
+		},
+	}
+}
+
+
+// The profile used when none is given
+func getDefaultProfileName(class string) string {
+	switch class {
+	case "root":
+		return "root-ca"
+	case "intermediate":
+		return "sub-ca"
+	default:
+		// Same usages as the certificates of older simpleca versions
+		return "mtls"
+	}
+}
+
+
+// Return the profile with the given name (or the default one of the class), checking it can be used for the class
+func getProfile(conf Conf, class, name string) (*Profile, error) {
+	if name == "" {
+		name = getDefaultProfileName(class)
+	}
+
+	profile, ok := conf.Profiles[name]
+	if !ok {
+		profile, ok = getDefaultProfiles()[name]
+	}
+	if !ok {
+		return nil, errors.New("unknown profile " + name + ", available profiles: " + strings.Join(getProfileNames(conf), ", "))
+	}
+
+	if class == "client" && (*profile).CA {
+		return nil, errors.New("the profile " + name + " is a CA profile, it can't be used for a client")
+	}
+	if class != "client" && !(*profile).CA {
+		return nil, errors.New("the profile " + name + " is not a CA profile, it can't be used for a " + class)
+	}
+
+	return profile, nil
+}
+
+
+func getProfileNames(conf Conf) []string {
+	var names []string
+
+	for name := range getDefaultProfiles() {
+		names = append(names, name)
+	}
+	for name := range conf.Profiles {
+		if _, ok := getDefaultProfiles()[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+
+// Build the certificate to sign from the subject and the profile
+func getCertificate(serial *big.Int, profile *Profile, subject pkix.Name, sans *subjectAltNames, pubKey interface{}, notBefore, notAfter time.Time) (*x509.Certificate, error) {
+	var cert *x509.Certificate = &x509.Certificate{
+		SerialNumber: serial,
+		Subject:               subject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  (*profile).CA,
+		BasicConstraintsValid: true,
+	}
+
+	for _, usage := range (*profile).KeyUsage {
+		keyUsage, ok := keyUsages[usage]
+		if !ok {
+			return nil, errors.New("unknown key usage " + usage)
+		}
+		cert.KeyUsage |= keyUsage
+	}
+
+	for _, usage := range (*profile).ExtKeyUsage {
+		extKeyUsage, ok := extKeyUsages[usage]
+		if !ok {
+			return nil, errors.New("unknown extended key usage " + usage)
+		}
+		cert.ExtKeyUsage = append(cert.ExtKeyUsage, extKeyUsage)
+
+		// RSA key exchange (TLS 1.2 and before) needs the server key to encrypt the premaster secret
+		if extKeyUsage == x509.ExtKeyUsageServerAuth && getKeyType(pubKey) == RSA {
+			cert.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+
+	// The alternative names should contain all names (the CommonName should not be used)
+	names, err := sans.withCommonName(subject.CommonName, (*profile).CommonNameAsSAN)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.DNSNames = names.DNSNames
+	cert.IPAddresses = names.IPAddresses
+	cert.EmailAddresses = names.EmailAddresses
+	cert.URIs = names.URIs
+
+	if (*profile).OCSPNoCheck {
+		cert.ExtraExtensions = append(cert.ExtraExtensions, pkix.Extension{Id: oidOCSPNoCheck, Value: asn1.NullBytes})
+	}
+
+	err = setPolicies(cert, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
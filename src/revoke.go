@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+
+// The revocation reasons (RFC 5280), named as in OpenSSL databases
+var revocationReasons map[string]int = map[string]int{
+	"unspecified": 0,
+	"keyCompromise": 1,
+	"CACompromise": 2,
+	"affiliationChanged": 3,
+	"superseded": 4,
+	"cessationOfOperation": 5,
+	"certificateHold": 6,
+	"removeFromCRL": 8,
+	"privilegeWithdrawn": 9,
+	"AACompromise": 10,
+}
+
+
+func getHelpRevoke() string {
+	return `Usage: simpleca revoke <class> [--name=<name>] [--reason=<reason>]
+
+Revoke a certificate: its serial number, the revocation date and the reason are recorded in the repository, under the
+CA which issued it. Revocations are kept when the key is removed with "simpleca rm", unless its CA is removed too.
+
+Available classes:
+	intermediate   revoke an intermediate CA certificate (it can't sign anymore)
+	client         revoke a client certificate
+
+--name string
+	(optional) The name of the key.
+
+--reason string
+	(optional) Why the certificate is revoked: unspecified (default), keyCompromise, CACompromise, affiliationChanged,
+	superseded, cessationOfOperation, certificateHold or privilegeWithdrawn.`
+}
+
+
+func revoke(state *State, class, keyName, reason string) (string, error) {
+	switch class {
+	case "intermediate":
+		if keyName == "" {
+			keyName = "intermediate"
+		}
+	case "client":
+		if keyName == "" {
+			keyName = "client"
+		}
+	case "root":
+		return "", errors.New("the root certificate can't be revoked, create a new repository to replace this CA")
+	default:
+		return "", errors.New("missing class\n\n" + getHelpRevoke())
+	}
+
+	reason, err := getRevocationReason(reason)
+	if err != nil {
+		return "", err
+	}
+	if reason == "removeFromCRL" {
+		return "", errors.New("removeFromCRL is only used in delta CRLs, it can't be a revocation reason")
+	}
+
+	el, ok := (*state).get(class, keyName)
+	if !ok {
+		return "", errors.New("key " + keyName + " is not known")
+	}
+	if (*el).SerialNumber == "" {
+		return "", errors.New(keyName + " has not been signed, there is nothing to revoke")
+	}
+
+	_, cert, err := loadCertificate((*el).Path)
+	if err != nil {
+		return "", err
+	}
+
+	ca, err := getIssuerName(state, cert)
+	if err != nil {
+		return "", err
+	}
+
+	if revocation := (*state).getRevocation(ca, (*el).SerialNumber); revocation != nil {
+		return "", errors.New("the certificate of " + keyName + " has already been revoked by " + ca + " on " + (*revocation).RevokedOn.UTC().Format(time.RFC3339))
+	}
+
+	(*state).revoke(ca, &Revocation{
+		Name: keyName,
+		SerialNumber: (*el).SerialNumber,
+		RevokedOn: time.Now().UTC(),
+		Reason: reason,
+		ValidUntil: cert.NotAfter,
+		Subject: formatDN(cert),
+	})
+
+	return "Certificate of " + keyName + " revoked by " + ca + " (" + reason + ")", nil
+}
+
+
+// Return the canonical name of the revocation reason, whatever its case
+func getRevocationReason(reason string) (string, error) {
+	var names []string
+
+	if reason == "" {
+		return "unspecified", nil
+	}
+
+	for name := range revocationReasons {
+		if strings.EqualFold(name, reason) {
+			return name, nil
+		}
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return "", errors.New("unknown revocation reason " + reason + ", available reasons: " + strings.Join(names, ", "))
+}
+
+
+// Return the revocation of the certificate the CA issued with the given serial number, if any (serial numbers are only
+// unique per CA)
+func (s *State) getRevocation(ca, serialNumber string) *Revocation {
+	for _, revocation := range s.Revocations[ca] {
+		if (*revocation).SerialNumber == serialNumber {
+			return revocation
+		}
+	}
+
+	return nil
+}
+
+
+// Return the name of the CA of the repository which issued the certificate
+func getIssuerName(state *State, cert *x509.Certificate) (string, error) {
+	for _, cas := range []map[string]*Element{(*state).Intermediates, (*state).Root} {
+		for name, ca := range cas {
+			if (*ca).SerialNumber == "" {
+				continue
+			}
+
+			_, caCert, err := loadCertificate((*ca).Path)
+			if err != nil {
+				return "", err
+			}
+
+			if cert.CheckSignatureFrom(caCert) == nil {
+				return name, nil
+			}
+		}
+	}
+
+	return "", errors.New("the certificate has not been issued by a CA of the repository, only its issuer can revoke it")
+}
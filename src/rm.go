@@ -38,14 +38,25 @@ func rm(state *State, conf Conf, class string, name string) error {
 		return errors.New("can't delete a " + class)
 	}
 
+	err = checkName(name)
+	if err != nil {
+		return err
+	}
+
 	var fullPath string = path + "/" + name
 
 	var privKeyPath string = getPrivKeyPath(fullPath)
 	var pubKeyPath string = getPubKeyPath(fullPath)
 	var certPath string = getCertPath(fullPath)
+	var certDerPath string = getCertDerPath(fullPath)
 	var fullCertPath string = getFullCertPath(fullPath)
+	var csrPath string = getCSRPath(fullPath)
+	var crlPath string = getCRLPath(fullPath)
+	var crlPemPath string = getCRLPemPath(fullPath)
+	var deltaCRLPath string = getDeltaCRLPath(fullPath)
+	var deltaCRLPemPath string = getDeltaCRLPemPath(fullPath)
 
-	for _, file := range []string{privKeyPath, pubKeyPath, certPath, fullCertPath} {
+	for _, file := range []string{privKeyPath, pubKeyPath, certPath, certDerPath, fullCertPath, csrPath, crlPath, crlPemPath, deltaCRLPath, deltaCRLPemPath} {
 		if _, err = os.Stat(file); err == nil {
 			err = os.Remove(file)
 			if err != nil {
@@ -58,6 +69,8 @@ func rm(state *State, conf Conf, class string, name string) error {
 		delete((*state).Clients, name)
 	} else if class == "intermediate" {
 		delete((*state).Intermediates, name)
+		// A new intermediate with the same name must not inherit the revocations of this one
+		delete((*state).Revocations, name)
 	}
 
 	return nil
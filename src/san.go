@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/url"
+	"strings"
+)
+
+
+// The subject alternative names of a certificate, by type
+type subjectAltNames struct {
+	DNSNames []string
+	IPAddresses []net.IP
+	EmailAddresses []string
+	URIs []*url.URL
+
+	// Do not add the CommonName, even if the profile says so
+	NoCommonName bool
+}
+
+
+// The flags setting the subject alternative names
+type subjectAltNamesFlags struct {
+	altNames, ips, emails, uris stringArray
+	noCommonName bool
+}
+
+
+func (f *subjectAltNamesFlags) addFlags(commands *flag.FlagSet) {
+	commands.Var(&f.altNames, "altname", "")
+	commands.Var(&f.ips, "ip", "")
+	commands.Var(&f.emails, "email", "")
+	commands.Var(&f.uris, "uri", "")
+	commands.BoolVar(&f.noCommonName, "no-cn-san", false, "")
+}
+
+
+// The help of the flags registered by addFlags
+func getHelpSubjectAltNames() string {
+	return `--altname string
+	(optional) An additional name this certificate will include. Its type is detected: IP address, email address
+	(containing a @), URI (containing ://) or DNS name. You can provide this parameter multiple times.
+
+--ip string
+	(optional) An additional IP address. You can provide this parameter multiple times.
+
+--email string
+	(optional) An additional email address. You can provide this parameter multiple times.
+
+--uri string
+	(optional) An additional URI (spiffe://domain.com/service for instance). You can provide this parameter multiple
+	times.
+
+--no-cn-san
+	(optional) Do not add the CommonName to the alternative names (when it is not a host name, for a user certificate
+	for instance).`
+}
+
+
+func (f *subjectAltNamesFlags) get() (*subjectAltNames, error) {
+	var sans *subjectAltNames = &subjectAltNames{NoCommonName: f.noCommonName}
+
+	for _, name := range f.altNames {
+		if err := sans.add(name); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range f.ips {
+		if err := sans.addIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	for _, email := range f.emails {
+		if err := sans.addEmail(email); err != nil {
+			return nil, err
+		}
+	}
+	for _, uri := range f.uris {
+		if err := sans.addURI(uri); err != nil {
+			return nil, err
+		}
+	}
+
+	return sans, nil
+}
+
+
+// Add the name, detecting its type
+func (s *subjectAltNames) add(name string) error {
+	switch {
+	case net.ParseIP(name) != nil:
+		return s.addIP(name)
+	case strings.Contains(name, "://"):
+		return s.addURI(name)
+	case strings.Contains(name, "@"):
+		return s.addEmail(name)
+	default:
+		return s.addDNS(name)
+	}
+}
+
+
+func (s *subjectAltNames) addDNS(name string) error {
+	if !isDNSName(name) {
+		return errors.New(name + " is not a valid DNS name")
+	}
+
+	for _, dnsName := range s.DNSNames {
+		if strings.EqualFold(dnsName, name) {
+			return nil
+		}
+	}
+
+	s.DNSNames = append(s.DNSNames, name)
+
+	return nil
+}
+
+
+func (s *subjectAltNames) addIP(value string) error {
+	var ip net.IP = net.ParseIP(value)
+	if ip == nil {
+		return errors.New(value + " is not a valid IP address")
+	}
+
+	for _, other := range s.IPAddresses {
+		if other.Equal(ip) {
+			return nil
+		}
+	}
+
+	s.IPAddresses = append(s.IPAddresses, ip)
+
+	return nil
+}
+
+
+func (s *subjectAltNames) addEmail(email string) error {
+	var parts []string = strings.Split(email, "@")
+	if len(parts) != 2 || parts[0] == "" || !isDNSName(parts[1]) {
+		return errors.New(email + " is not a valid email address")
+	}
+
+	if !contains(s.EmailAddresses, email) {
+		s.EmailAddresses = append(s.EmailAddresses, email)
+	}
+
+	return nil
+}
+
+
+func (s *subjectAltNames) addURI(value string) error {
+	uri, err := url.Parse(value)
+	if err != nil || uri.Scheme == "" || !uri.IsAbs() {
+		return errors.New(value + " is not a valid URI")
+	}
+
+	for _, other := range s.URIs {
+		if other.String() == uri.String() {
+			return nil
+		}
+	}
+
+	s.URIs = append(s.URIs, uri)
+
+	return nil
+}
+
+
+// Add the names of the other (those of a certificate signing request for instance)
+func (s *subjectAltNames) merge(other *subjectAltNames) {
+	for _, dnsName := range other.DNSNames {
+		s.addDNS(dnsName)
+	}
+	for _, ip := range other.IPAddresses {
+		s.addIP(ip.String())
+	}
+	for _, email := range other.EmailAddresses {
+		s.addEmail(email)
+	}
+	for _, uri := range other.URIs {
+		s.addURI(uri.String())
+	}
+}
+
+
+// Return the alternative names of a certificate for the given CommonName: the CommonName comes first if it has to be
+// included
+func (s *subjectAltNames) withCommonName(commonName string, addCommonName bool) (*subjectAltNames, error) {
+	var result *subjectAltNames = &subjectAltNames{}
+
+	if addCommonName && !s.NoCommonName {
+		if err := result.add(commonName); err != nil {
+			return nil, errors.New("the CommonName can't be added to the alternative names: " + err.Error() + " (use --no-cn-san)")
+		}
+	}
+
+	result.merge(s)
+
+	return result, nil
+}
+
+
+// Host names, with an optional wildcard as first label (underscores are accepted, they are common in internal names)
+func isDNSName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+
+const keyShareHeader = "SIMPLECA KEY SHARE"
+
+
+func getHelpSplit() string {
+	return `Usage: simpleca split root --shares=<n> --threshold=<k> [--out=<folder> | --print] [--remove-key]
+                      [--share=<file>]
+
+Split the root private key in n shares with Shamir's secret sharing: any k of them rebuild the key, less than k reveal
+nothing about it. Give each share to a different custodian, then sign with the root key using --share (see
+"simpleca help sign").
+
+Shares are PEM files which can be printed. They are not encrypted: keep them as safe as the key itself.
+
+--shares int
+	The number of shares to create (at most 255).
+
+--threshold int
+	The number of shares needed to rebuild the key (at least 2).
+
+--out string
+	(optional) The folder to write the shares in (root.share-<i>-of-<n>.pem files). Defaults to the current folder.
+
+--print
+	(optional) Print the shares instead of writing them to files.
+
+--remove-key
+	(optional) Remove the private key from the repository once the shares are written.
+
+--share string
+	(optional) A share of the key, if it has already been split (to split it again with other parameters, when
+	custodians change for instance). Provide this parameter once per share.
+
+` + getHelpPassphrase("", "the root key") + `
+
+` + getHelpAskpass()
+}
+
+
+func split(state *State, class string, shares, threshold int, out string, printShares, removeKey bool, shareFiles []string, pass *passphraseSource) (string, error) {
+	var err error
+
+	if class != "root" {
+		return "", errors.New("only the root key can be split\n\n" + getHelpSplit())
+	}
+
+	if threshold < 2 || shares < threshold || shares > 255 {
+		return "", errors.New("invalid --shares and --threshold: at least 2 shares must be needed, and at most 255 shares can be created")
+	}
+
+	keyInState, ok := (*state).get(class, "root")
+	if !ok {
+		return "", errors.New("key root is not known")
+	}
+
+	if (*keyInState).PKCS11 != "" {
+		return "", errors.New("the root key is on a PKCS#11 token, it can't be split")
+	}
+
+	var privKey, pubKey interface{}
+
+	if len(shareFiles) > 0 {
+		var signer crypto.Signer
+
+		signer, err = loadSharedKey(keyInState, shareFiles)
+		if err == nil {
+			privKey, pubKey = signer, signer.Public()
+		}
+	} else {
+		privKey, pubKey, err = loadPrivKey((*keyInState).Type, (*keyInState).Path, pass)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return "", err
+	}
+
+	fingerprint, err := getFingerprint(pubKey)
+	if err != nil {
+		return "", err
+	}
+
+	parts, err := shamirSplit(secret, shares, threshold)
+	if err != nil {
+		return "", err
+	}
+
+	var output []string
+
+	if !printShares {
+		err = os.MkdirAll(out, 0700)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for i, part := range parts {
+		var block *pem.Block = &pem.Block{
+			Type: keyShareHeader,
+			Headers: map[string]string{
+				"Key": "root",
+				"Fingerprint": fingerprint,
+				"Share": strconv.Itoa(i + 1) + "/" + strconv.Itoa(shares),
+				"Threshold": strconv.Itoa(threshold),
+			},
+			Bytes: part,
+		}
+
+		if printShares {
+			output = append(output, strings.TrimSpace(string(pem.EncodeToMemory(block))))
+			continue
+		}
+
+		var sharePath string = filepath.Join(out, "root.share-" + strconv.Itoa(i + 1) + "-of-" + strconv.Itoa(shares) + ".pem")
+
+		err = writeFileAtomic(sharePath, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			return "", err
+		}
+
+		output = append(output, "Share " + strconv.Itoa(i + 1) + " written in " + sharePath)
+	}
+
+	(*keyInState).Shares = shares
+	(*keyInState).Threshold = threshold
+
+	if removeKey && len(shareFiles) == 0 {
+		err = os.Remove(getPrivKeyPath((*keyInState).Path))
+		if err != nil {
+			return "", err
+		}
+
+		output = append(output, "Private key " + getPrivKeyPath((*keyInState).Path) + " removed, " + strconv.Itoa(threshold) + " shares are now needed to sign with the root key")
+	}
+
+	if printShares {
+		return strings.Join(output, "\n\n"), nil
+	}
+
+	return strings.Join(output, "\n"), nil
+}
+
+
+// Rebuild the private key of the element from the given share files
+func loadSharedKey(el *Element, shareFiles []string) (crypto.Signer, error) {
+	var err error
+
+	pubKey, err := loadPubKey((*el).Path)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := getFingerprint(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts [][]byte
+	var seen map[byte]bool = make(map[byte]bool)
+
+	for _, shareFile := range shareFiles {
+		block, err := readPemFile(shareFile, keyShareHeader)
+		if err != nil {
+			return nil, err
+		}
+
+		if block.Headers["Fingerprint"] != fingerprint {
+			return nil, errors.New("the share " + shareFile + " is not a share of the key " + getPrivKeyPath((*el).Path))
+		}
+
+		if len(block.Bytes) < 2 {
+			return nil, errors.New("the share " + shareFile + " is invalid")
+		}
+
+		if seen[block.Bytes[0]] {
+			return nil, errors.New("the share " + shareFile + " has been given twice")
+		}
+		seen[block.Bytes[0]] = true
+
+		parts = append(parts, block.Bytes)
+	}
+
+	if (*el).Threshold > 0 && len(parts) < (*el).Threshold {
+		return nil, errors.New(strconv.Itoa((*el).Threshold) + " shares are needed to rebuild the key, only " + strconv.Itoa(len(parts)) + " given")
+	}
+
+	secret, err := shamirCombine(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	privKey, err := x509.ParsePKCS8PrivateKey(secret)
+	if err != nil {
+		return nil, errors.New("can't rebuild the key from the given shares (not enough shares?)")
+	}
+
+	signer, ok := privKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("the rebuilt key can't be used to sign")
+	}
+
+	if rebuilt, err := getFingerprint(signer.Public()); err != nil || rebuilt != fingerprint {
+		return nil, errors.New("can't rebuild the key from the given shares (not enough shares?)")
+	}
+
+	fmt.Println("Key of " + (*el).Path + " rebuilt from " + strconv.Itoa(len(parts)) + " shares")
+
+	return signer, nil
+}
+
+
+// Split the secret in n shares, k of them being needed to rebuild it. Each byte of the secret is the constant term of a
+// random polynomial of degree k-1 over GF(256), share i contains i followed by the values of the polynomials at i.
+func shamirSplit(secret []byte, n, k int) ([][]byte, error) {
+	var shares [][]byte = make([][]byte, n)
+
+	for i := range shares {
+		shares[i] = make([]byte, len(secret) + 1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	var coefficients []byte = make([]byte, k)
+
+	for b, value := range secret {
+		_, err := rand.Read(coefficients[1:])
+		if err != nil {
+			return nil, err
+		}
+		coefficients[0] = value
+
+		for i := range shares {
+			// Horner's method
+			var x byte = shares[i][0]
+			var y byte
+
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+
+			shares[i][b + 1] = y
+		}
+	}
+
+	return shares, nil
+}
+
+
+// Rebuild the secret by Lagrange interpolation at 0
+func shamirCombine(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no share given")
+	}
+
+	var secret []byte = make([]byte, len(shares[0]) - 1)
+
+	for i, share := range shares {
+		if len(share) != len(shares[0]) {
+			return nil, errors.New("the shares do not have the same length")
+		}
+
+		// Lagrange basis polynomial of this share at 0 (in GF(256), subtraction is addition is xor)
+		var basis byte = 1
+
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfDiv(other[0], other[0] ^ share[0]))
+			}
+		}
+
+		for b := range secret {
+			secret[b] ^= gfMul(share[b + 1], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+
+// Multiplication in GF(256) with the AES polynomial x^8 + x^4 + x^3 + x + 1
+func gfMul(a, b byte) byte {
+	var result byte
+
+	for b > 0 {
+		if b & 1 == 1 {
+			result ^= a
+		}
+
+		var carry bool = a & 0x80 != 0
+		a <<= 1
+		if carry {
+			a ^= 0x1b
+		}
+
+		b >>= 1
+	}
+
+	return result
+}
+
+
+// a / b in GF(256), b must not be 0 (b^254 is the inverse of b)
+func gfDiv(a, b byte) byte {
+	var inverse byte = 1
+
+	for i := 0; i < 254; i++ {
+		inverse = gfMul(inverse, b)
+	}
+
+	return gfMul(a, inverse)
+}
@@ -1,22 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"math/big"
 	"os"
-	"time"
+	"strconv"
 )
 
 
 func getHelpSign() string {
-	return `Usage: simpleca sign <class> [--name=<name>] [--altname=<altname>] [--with=<ca name>]
-
-Sign a key (generate a certificate). Note that the name of the key will be the CommonName in the certificate.
+	return `Usage: simpleca sign <class> [--name=<name>] [--altname=<altname>] [--ip=<ip>] [--email=<email>] [--uri=<uri>]
+                     [--no-cn-san] [--with=<ca name>] [--profile=<profile>] [--share=<file>]
+                     [--permitted-dns=<domain>] [--excluded-dns=<domain>] [--permitted-ip=<range>]
+                     [--excluded-ip=<range>] [--permitted-email=<domain>] [--excluded-email=<domain>]
+                     [--permitted-uri=<domain>] [--excluded-uri=<domain>] [--max-path-len=<length>]
+                     [--days=<days>] [--hours=<hours>] [--not-after=<date>] [--subject=<dn>] [--var=<name=value>]
+                     [--ou=<ou>] [--province=<province>] [--street=<street>] [--postal-code=<code>]
+                     [--subject-email=<email>] [--subject-serial=<serial>] [--policy=<oid>]
+                     [--require-explicit-policy=<n>] [--inhibit-policy-mapping=<n>] [--inhibit-any-policy=<n>]
+                     [--extension=<extension>]
+
+Sign a key (generate a certificate). Note that the name of the key will be the CommonName in the certificate, unless
+another one is given in the subject.
+
+The certificate is built from the public key file (.pub) of the key: its private key is only needed to self-sign it,
+so only the passphrase of the CA key is asked otherwise.
 
 Available classes:
 	root           sign a root CA (most certainly without any option to have a self-signed root CA)
@@ -27,16 +41,47 @@ Available classes:
 	(optional) The name of the key to sign (only needed if you gave a custom name to your key - which you probably
 	should have done).
 
---altname string
-	(optional) The additional DNS name this certificate will include. You can provide this parameter multiple times.
+` + getHelpSubjectAltNames() + `
+
+` + getHelpSubject() + `
 
 --with string
 	(optional) Sign the key with the given object (this should be the name of an intermediate CA for signing a client
-	key, or "root" if you want to sign an intermediate CA). Omit this option to self-sign the given key.`
+	key, or "root" if you want to sign an intermediate CA). Omit this option to self-sign the given key.
+
+--profile string
+	(optional) What the certificate can be used for: server, client, mtls (server and client), code-signing, email,
+	ocsp-signing, root-ca, sub-ca or any profile defined in the configuration. Defaults to root-ca for the root, sub-ca
+	for intermediates and mtls for clients.
+
+` + getHelpValidity() + `
+	A certificate can't outlive its CA: the default validity is shortened to the one of the CA, an explicit one is
+	refused.
+
+` + getHelpPolicies() + `
+
+--max-path-len string
+	(optional, root and intermediate only) How many intermediate CAs can follow this CA in a chain: a number, or
+	"unlimited". Defaults to unlimited for the root and 0 for intermediates (they can only sign clients).
+
+--share string
+	(optional) A share of the signing key, if it has been split with "simpleca split". Provide this parameter once per
+	share: the key is rebuilt in memory when enough shares are given.
+
+Name constraints limit the names an intermediate CA can issue certificates for (they are marked critical). A
+certificate breaking the name constraints of its issuer is refused.
+
+` + getHelpNameConstraints() + `
+
+` + getHelpPassphrase("", "the signed key") + `
+
+` + getHelpPassphrase("with-", "the CA key given with --with") + `
+
+` + getHelpAskpass()
 }
 
 
-func sign(state *State, conf Conf, class, with, keyName string, altNames []string) error {
+func sign(state *State, conf Conf, class, with, keyName, profileName, maxPathLen string, sans *subjectAltNames, subjectFlags *subjectFlags, constraints *nameConstraintsFlags, policies *policyFlags, validity *validityFlags, shares []string, pass, withPass *passphraseSource) error {
 	var err error
 
 	switch class {
@@ -66,7 +111,46 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 		return errors.New("key " + keyName + " is not known")
 	}
 
-	privKey, pubKey, err = loadPrivKey((*keyInState).Type, (*keyInState).Path)
+	profile, err := getProfile(conf, class, profileName)
+	if err != nil {
+		return err
+	}
+
+	profile, err = policies.apply(profile)
+	if err != nil {
+		return err
+	}
+
+	if class != "intermediate" && constraints.isSet() {
+		return errors.New("name constraints can only be set on intermediate CAs")
+	}
+
+	if class == "client" && maxPathLen != "" {
+		return errors.New("a path length can only be set on CAs")
+	}
+
+	if (*keyInState).ExternalIssuer != "" {
+		return errors.New("the certificate of " + keyName + " is issued by the external CA " + (*keyInState).ExternalIssuer + ": create a new request with \"simpleca csr\" and import the new certificate with \"simpleca import\"")
+	}
+
+	if with == "" {
+		// Self-signing needs the private key (which may be on a token, held by the agent or split in shares)
+		var signer crypto.Signer
+
+		signer, err = loadCASigner(keyInState, shares, pass)
+		if err == nil {
+			defer closeSigner(signer)
+			privKey, pubKey = signer, signer.Public()
+		}
+	} else if _, statErr := os.Stat(getPubKeyPath((*keyInState).Path)); statErr == nil {
+		// The certificate is built from the public key file, the private key may not even be in the repository
+		pubKey, err = loadPubKey((*keyInState).Path)
+	} else {
+		privKey, pubKey, err = loadPrivKey((*keyInState).Type, (*keyInState).Path, pass)
+	}
+	if err != nil {
+		return err
+	}
 
 	var cert []byte
 	var certStruct *x509.Certificate
@@ -76,19 +160,40 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 	// If we are signing a client key, this will tell the user about the fullchain file
 	var additionalMessage string
 
-	serial, err = rand.Int(rand.Reader, (&big.Int{}).Exp(big.NewInt(2), big.NewInt(159), nil))
+	serial, err = newSerial()
 	if err != nil {
 		return err
 	}
 
-	if with == "" {
-		// Self-signed certificate
-		if class == "client" {
-			certStruct = getCertForClient(serial, conf.CertificateDuration, keyName, altNames, conf.Organization, conf.Country, conf.Locality)
-		} else {
-			certStruct = getCertForCA(serial, conf.CertificateDuration, keyName, altNames, conf.Organization, conf.Country, conf.Locality)
+	notBefore, notAfter, explicitValidity, err := validity.get(conf, class)
+	if err != nil {
+		return err
+	}
+
+	subject, err := getSubject(conf, class, profileName, profile, keyName, subjectFlags)
+	if err != nil {
+		return err
+	}
+
+	certStruct, err = getCertificate(serial, profile, subject, sans, pubKey, notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+
+	err = constraints.apply(certStruct)
+	if err != nil {
+		return err
+	}
+
+	if class != "client" {
+		err = setMaxPathLen(certStruct, class, maxPathLen)
+		if err != nil {
+			return err
 		}
+	}
 
+	if with == "" {
+		// Self-signed certificate
 		cert, err = x509.CreateCertificate(rand.Reader, certStruct, certStruct, pubKey, privKey)
 		if err != nil {
 			return err
@@ -97,34 +202,56 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 	} else {
 		var withElement *Element
 
-		// Retrieve the element first from intermediate CAs, else from the root CA
-		withElement, ok = (*state).get("intermediate", with)
-		if !ok {
-			withElement, ok = (*state).get("root", with)
-			if !ok {
-				return errors.New("can't find a CA named " + with)
-			}
+		withElement, err = getCA(state, with)
+		if err != nil {
+			return err
 		}
 
-		var withPrivKey interface{}
-		var withCertificatePem *pem.Block
+		var withPrivKey crypto.Signer
 		var withCertificateX509 *x509.Certificate
 
 		// Load the keys
-		withPrivKey, _, err = loadPrivKey((*withElement).Type, (*withElement).Path)
+		withPrivKey, err = loadCASigner(withElement, shares, withPass)
 		if err != nil {
 			return err
 		}
+		defer closeSigner(withPrivKey)
 
-		withCertificatePem, withCertificateX509, err = loadCertificate((*withElement).Path)
+		_, withCertificateX509, err = loadCertificate((*withElement).Path)
 		if err != nil {
 			return err
 		}
 
-		if class == "client" {
-			certStruct = getCertForClient(serial, conf.CertificateDuration, keyName, altNames, conf.Organization, conf.Country, conf.Locality)
-		} else {
-			certStruct = getCertForCA(serial, conf.CertificateDuration, keyName, altNames, conf.Organization, conf.Country, conf.Locality)
+		var validityMessage string
+
+		certStruct.NotAfter, validityMessage, err = capNotAfter(certStruct.NotAfter, explicitValidity, with, withCertificateX509.NotAfter)
+		if err != nil {
+			return err
+		}
+		if validityMessage != "" {
+			fmt.Println(validityMessage)
+		}
+
+		err = setCAURLs(certStruct, conf, with)
+		if err != nil {
+			return err
+		}
+
+		issuerChain, err := getIssuerChain(state, withElement, withCertificateX509)
+		if err != nil {
+			return err
+		}
+
+		err = checkNameConstraints(certStruct, issuerChain)
+		if err != nil {
+			return err
+		}
+
+		if class != "client" {
+			err = checkMaxPathLen(certStruct, withCertificateX509)
+			if err != nil {
+				return err
+			}
 		}
 
 		cert, err = x509.CreateCertificate(rand.Reader, certStruct, withCertificateX509, pubKey, withPrivKey)
@@ -132,18 +259,20 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 			return err
 		}
 
-		// If this is a client key, create the full chain too
-		if class == "client" {
+		chain, caHasChain, err := getCAChain(state, withElement, withCertificateX509)
+		if err != nil {
+			return err
+		}
+
+		// If this is a client key, or if the CA has a chain (up to an external root for instance), create the full chain
+		// too
+		if class == "client" || caHasChain {
 			var fullchainCertPath = getFullCertPath((*keyInState).Path)
 
-			fullchainCertFile, err := os.OpenFile(fullchainCertPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			err = writeFileAtomic(fullchainCertPath, append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), chain...), 0600)
 			if err != nil {
 				return err
 			}
-			defer fullchainCertFile.Close()
-
-			pem.Encode(fullchainCertFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
-			pem.Encode(fullchainCertFile, withCertificatePem)
 
 			additionalMessage = "A full chain certificate file is also available at " + fullchainCertPath
 		}
@@ -159,6 +288,13 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 
 	pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
 
+	if class != "client" {
+		err = writeFileAtomic(getCertDerPath((*keyInState).Path), cert, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Save the serial number
 	el, ok := (*state).get(class, keyName)
 	if !ok {
@@ -166,6 +302,7 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 	}
 
 	(*el).SerialNumber = (*serial).String()
+	(*el).ValidUntil = (*certStruct).NotAfter
 
 	fmt.Println(keyName + " key signed, certificate available in " + certPath)
 	if additionalMessage != "" {
@@ -176,44 +313,113 @@ func sign(state *State, conf Conf, class, with, keyName string, altNames []strin
 }
 
 
-func getCertForCA(serial *big.Int, duration int, commonName string, subjectAltNames []string, organization, country, locality string) *x509.Certificate {
-	// The DNSNames field should contain all names (the CommonName should not be used)
-	var dnsNames = append([]string{commonName}, subjectAltNames...)
-
-	return &x509.Certificate{
-		SerialNumber: serial,
-		Subject: pkix.Name{
-			Organization:  []string{organization},
-			Country:       []string{country},
-			Locality:      []string{locality},
-			CommonName:    commonName,
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(0, duration, 0),
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-		DNSNames:              dnsNames,
+// Random 159 bits serial number (serial numbers must be positive and at most 20 bytes long)
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, (&big.Int{}).Exp(big.NewInt(2), big.NewInt(159), nil))
+}
+
+
+// Set the path length constraint of a CA certificate, unlimited for the root and 0 for intermediates by default
+func setMaxPathLen(cert *x509.Certificate, class, maxPathLen string) error {
+	if maxPathLen == "" {
+		if class == "root" {
+			maxPathLen = "unlimited"
+		} else {
+			maxPathLen = "0"
+		}
+	}
+
+	if maxPathLen == "unlimited" {
+		cert.MaxPathLen = -1
+		return nil
+	}
+
+	length, err := strconv.Atoi(maxPathLen)
+	if err != nil || length < 0 {
+		return errors.New("the path length must be a positive number or \"unlimited\"")
+	}
+
+	cert.MaxPathLen = length
+	cert.MaxPathLenZero = length == 0
+
+	return nil
+}
+
+
+// Refuse to sign a CA certificate that the path length constraint of the issuer does not allow
+func checkMaxPathLen(cert, issuer *x509.Certificate) error {
+	if issuer.MaxPathLen == 0 && issuer.MaxPathLenZero {
+		return errors.New("the path length of " + issuer.Subject.CommonName + " is 0, it can't sign CA certificates")
+	}
+
+	if issuer.MaxPathLen > 0 && (cert.MaxPathLen < 0 || cert.MaxPathLen >= issuer.MaxPathLen) {
+		return errors.New("the path length of " + issuer.Subject.CommonName + " is " + strconv.Itoa(issuer.MaxPathLen) + ", the path length of the certificate must be lower")
+	}
+
+	return nil
+}
+
+
+// Retrieve the CA first from intermediate CAs, else from the root CA, refusing revoked CAs
+func getCA(state *State, with string) (*Element, error) {
+	withElement, ok := (*state).get("intermediate", with)
+	if !ok {
+		withElement, ok = (*state).get("root", with)
+		if !ok {
+			return nil, errors.New("can't find a CA named " + with)
+		}
+	}
+
+	// Only intermediates can be revoked, by the CA which issued them
+	if _, ok = (*state).get("intermediate", with); ok && (*withElement).SerialNumber != "" {
+		_, withCertificate, err := loadCertificate((*withElement).Path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Intermediates issued by an external CA (subordinate CAs) can't be revoked by simpleca
+		if issuer, err := getIssuerName(state, withCertificate); err == nil && (*state).getRevocation(issuer, (*withElement).SerialNumber) != nil {
+			return nil, errors.New("the certificate of " + with + " has been revoked, it can't sign anymore")
+		}
+	}
+
+	return withElement, nil
+}
+
+
+// The certificates following the ones signed by the CA in full chain files: the CA certificate, then the current
+// certificates of its issuers but the root of the repository (true is returned if there are some)
+func getCAChain(state *State, withElement *Element, withCertificate *x509.Certificate) ([]byte, bool, error) {
+	certs, err := getIssuerChain(state, withElement, withCertificate)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if root, ok := (*state).get("root", "root"); ok && len(certs) > 1 && (*root).SerialNumber != "" {
+		_, rootCertificate, err := loadCertificate((*root).Path)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if bytes.Equal(certs[len(certs) - 1].Raw, rootCertificate.Raw) {
+			certs = certs[:len(certs) - 1]
+		}
 	}
+
+	var chain []byte
+	for _, cert := range certs {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+
+	return chain, len(certs) > 1, nil
 }
 
-func getCertForClient(serial *big.Int, duration int, commonName string, subjectAltNames []string, organization, country, locality string) *x509.Certificate {
-	// The DNSNames field should contain all names (the CommonName should not be used)
-	var dnsNames = append([]string{commonName}, subjectAltNames...)
-
-	return &x509.Certificate{
-		SerialNumber: serial,
-		Subject: pkix.Name{
-			Organization:  []string{organization},
-			Country:       []string{country},
-			Locality:      []string{locality},
-			CommonName:    commonName,
-		},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(0, duration, 0),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-		DNSNames:    dnsNames,
+
+// The CA key is rebuilt from its shares if some are given
+func loadCASigner(withElement *Element, shares []string, withPass *passphraseSource) (crypto.Signer, error) {
+	if len(shares) > 0 {
+		return loadSharedKey(withElement, shares)
 	}
+
+	return loadSigner(withElement, withPass)
 }
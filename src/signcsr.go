@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+)
+
+
+func getHelpSignCSR() string {
+	return `Usage: simpleca sign-csr --csr=<file> --with=<ca name> [--name=<name>] [--altname=<altname>]
+                         [--ip=<ip>] [--email=<email>] [--uri=<uri>] [--no-cn-san] [--profile=<profile>]
+                         [--days=<days>] [--hours=<hours>] [--not-after=<date>] [--subject=<dn>]
+                         [--var=<name=value>] [--ou=<ou>] [--province=<province>] [--street=<street>]
+                         [--postal-code=<code>] [--subject-email=<email>] [--subject-serial=<serial>] [--policy=<oid>]
+                         [--extension=<extension>] [--share=<file>]
+
+Sign a certificate signing request (PKCS#10) generated outside of simpleca, without holding its private key. The
+certificate and the full chain certificate are written in the clients folder and the client is recorded in the
+repository (without private key).
+
+The signature of the request is checked. Only its public key, CommonName and alternative names are used: the other
+subject fields come from the configuration and the subject options, as for the "sign" command.
+
+--csr string
+	The PEM encoded certificate signing request file.
+
+--with string
+	The name of the CA signing the request.
+
+--name string
+	(optional) The name of the client, also used as CommonName. Defaults to the CommonName of the request.
+
+` + getHelpSubjectAltNames() + `
+
+` + getHelpSubject() + `
+
+--profile string
+	(optional) What the certificate can be used for (see "simpleca help sign"). Defaults to mtls.
+
+` + getHelpValidity() + `
+
+` + getHelpPolicies() + `
+
+--share string
+	(optional) A share of the CA key, if it has been split with "simpleca split". Provide this parameter once per share.
+
+` + getHelpPassphrase("with-", "the CA key") + `
+
+` + getHelpAskpass()
+}
+
+
+func signCSR(state *State, conf Conf, csrFile, with, keyName, profileName string, sans *subjectAltNames, subjectFlags *subjectFlags, policies *policyFlags, validity *validityFlags, shares []string, withPass *passphraseSource) (string, error) {
+	var err error
+
+	if csrFile == "" {
+		return "", errors.New("missing --csr\n\n" + getHelpSignCSR())
+	}
+
+	if with == "" {
+		return "", errors.New("missing --with\n\n" + getHelpSignCSR())
+	}
+
+	profile, err := getProfile(conf, "client", profileName)
+	if err != nil {
+		return "", err
+	}
+
+	profile, err = policies.apply(profile)
+	if err != nil {
+		return "", err
+	}
+
+	csrPem, err := readPemFile(csrFile, "CERTIFICATE REQUEST")
+	if err != nil {
+		return "", err
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrPem.Bytes)
+	if err != nil {
+		return "", errors.New("can't parse the certificate signing request " + csrFile + ": " + err.Error())
+	}
+
+	err = csr.CheckSignature()
+	if err != nil {
+		return "", errors.New("invalid signature of the certificate signing request " + csrFile + ": " + err.Error())
+	}
+
+	if keyName == "" {
+		keyName = csr.Subject.CommonName
+	}
+	if keyName == "" {
+		return "", errors.New("the certificate signing request has no CommonName, give a name with --name")
+	}
+
+	err = checkName(keyName)
+	if err != nil {
+		return "", err
+	}
+
+	var path string = getPath("client", keyName)
+	var createdOn time.Time = time.Now()
+
+	// The certificate of a client signed from a request can be renewed, but not the one of a client we have the key of
+	if el, ok := (*state).get("client", keyName); ok {
+		if _, err = os.Stat(getPrivKeyPath(path)); err == nil {
+			return "", errors.New("client " + keyName + " already exists with its private key, use \"simpleca sign\" instead")
+		}
+
+		createdOn = (*el).CreatedOn
+	}
+
+	var keyType string = getKeyType(csr.PublicKey)
+	if keyType == "" {
+		return "", errors.New("unsupported key type in " + csrFile)
+	}
+
+	// The names of the request, then the ones given on the command line
+	var names *subjectAltNames = &subjectAltNames{NoCommonName: sans.NoCommonName}
+
+	for _, dnsName := range csr.DNSNames {
+		if err = names.addDNS(dnsName); err != nil {
+			return "", errors.New("invalid name in the certificate signing request: " + err.Error())
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		names.addIP(ip.String())
+	}
+	for _, email := range csr.EmailAddresses {
+		if err = names.addEmail(email); err != nil {
+			return "", errors.New("invalid name in the certificate signing request: " + err.Error())
+		}
+	}
+	for _, uri := range csr.URIs {
+		if err = names.addURI(uri.String()); err != nil {
+			return "", errors.New("invalid name in the certificate signing request: " + err.Error())
+		}
+	}
+
+	names.merge(sans)
+
+	withElement, err := getCA(state, with)
+	if err != nil {
+		return "", err
+	}
+
+	withPrivKey, err := loadCASigner(withElement, shares, withPass)
+	if err != nil {
+		return "", err
+	}
+	defer closeSigner(withPrivKey)
+
+	_, withCertificateX509, err := loadCertificate((*withElement).Path)
+	if err != nil {
+		return "", err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return "", err
+	}
+
+	notBefore, notAfter, explicitValidity, err := validity.get(conf, "client")
+	if err != nil {
+		return "", err
+	}
+
+	notAfter, validityMessage, err := capNotAfter(notAfter, explicitValidity, with, withCertificateX509.NotAfter)
+	if err != nil {
+		return "", err
+	}
+
+	subject, err := getSubject(conf, "client", profileName, profile, keyName, subjectFlags)
+	if err != nil {
+		return "", err
+	}
+
+	certStruct, err := getCertificate(serial, profile, subject, names, csr.PublicKey, notBefore, notAfter)
+	if err != nil {
+		return "", err
+	}
+
+	err = setCAURLs(certStruct, conf, with)
+	if err != nil {
+		return "", err
+	}
+
+	issuerChain, err := getIssuerChain(state, withElement, withCertificateX509)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkNameConstraints(certStruct, issuerChain)
+	if err != nil {
+		return "", err
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, certStruct, withCertificateX509, csr.PublicKey, withPrivKey)
+	if err != nil {
+		return "", err
+	}
+
+	// Write files
+	pubKeyPem, err := encodePubKey(csr.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(getPubKeyPath(path), pem.EncodeToMemory(pubKeyPem), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	var certPem []byte = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+
+	err = writeFileAtomic(getCertPath(path), certPem, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	chain, _, err := getCAChain(state, withElement, withCertificateX509)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(getFullCertPath(path), append(certPem, chain...), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	(*state).set("client", keyName, &Element{
+		Path: path,
+		Type: keyType,
+		Size: getKeySize(csr.PublicKey),
+		CreatedOn: createdOn,
+		ValidUntil: certStruct.NotAfter,
+		SerialNumber: serial.String(),
+	})
+
+	if validityMessage != "" {
+		validityMessage += "\n"
+	}
+
+	return validityMessage + "Request of " + keyName + " signed, certificate available in " + getCertPath(path) + "\nA full chain certificate file is also available at " + getFullCertPath(path), nil
+}
+
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -8,6 +8,7 @@ import (
 
 const (
 	ECDSA = "ecdsa"
+	ED25519 = "ed25519"
 	RSA = "rsa"
 )
 
@@ -20,12 +21,36 @@ type Element struct {
 	CreatedOn time.Time
 	ValidUntil time.Time
 	SerialNumber string
+	// If set, the private key is stored on a PKCS#11 token and not in the repository
+	PKCS11 string
+	// If set, the private key has been split in this many shares, Threshold of them are needed to rebuild it
+	Shares int
+	Threshold int
+	// If set, the certificate has been issued by this CA (its subject), which is not in the repository
+	ExternalIssuer string
+	// The number of the last CRL generated by this CA, and the number and date of its last base (full) CRL
+	CRLNumber int64 `json:",omitempty"`
+	BaseCRLNumber int64 `json:",omitempty"`
+	BaseCRLOn *time.Time `json:",omitempty"`
+}
+
+// A revoked certificate, kept in the state even when the element itself is removed
+type Revocation struct {
+	Name string
+	SerialNumber string
+	RevokedOn time.Time
+	Reason string
+	ValidUntil time.Time
+	// The subject, formatted as in OpenSSL databases
+	Subject string
 }
 
 type State struct {
 	Root map[string]*Element
 	Intermediates map[string]*Element
 	Clients map[string]*Element
+	// Revoked certificates, by issuing CA name
+	Revocations map[string][]*Revocation
 	LastModificationDate time.Time
 }
 
@@ -79,6 +104,14 @@ func (s *State) get(class, name string) (*Element, bool) {
 }
 
 
+func (s *State) revoke(ca string, revocation *Revocation) {
+	if s.Revocations == nil {
+		s.Revocations = make(map[string][]*Revocation)
+	}
+	s.Revocations[ca] = append(s.Revocations[ca], revocation)
+}
+
+
 func loadState() (State, error) {
 	var s State
 
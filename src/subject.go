@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"strings"
+	"text/template"
+)
+
+
+var oidEmailAddress asn1.ObjectIdentifier = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// The attribute types of subjects, by lower case name (RFC 4514 and OpenSSL names)
+var dnAttributeTypes map[string]string = map[string]string{
+	"cn": "CN",
+	"o": "O",
+	"ou": "OU",
+	"c": "C",
+	"st": "ST",
+	"l": "L",
+	"street": "STREET",
+	"postalcode": "POSTALCODE",
+	"emailaddress": "EMAILADDRESS",
+	"e": "EMAILADDRESS",
+	"serialnumber": "SERIALNUMBER",
+}
+
+
+// The flags setting the subject of a certificate
+type subjectFlags struct {
+	subject string
+	vars stringArray
+	ou, province, street, postalCode, email, serialNumber string
+}
+
+
+func (f *subjectFlags) addFlags(commands *flag.FlagSet) {
+	commands.StringVar(&f.subject, "subject", "", "")
+	commands.Var(&f.vars, "var", "")
+	commands.StringVar(&f.ou, "ou", "", "")
+	commands.StringVar(&f.province, "province", "", "")
+	commands.StringVar(&f.street, "street", "", "")
+	commands.StringVar(&f.postalCode, "postal-code", "", "")
+	commands.StringVar(&f.email, "subject-email", "", "")
+	commands.StringVar(&f.serialNumber, "subject-serial", "", "")
+}
+
+
+// The help of the flags registered by addFlags
+func getHelpSubject() string {
+	return `--subject string
+	(optional) The subject, as a RFC 4514 string ("CN=jane,O=developers"). Its attributes replace the ones of the
+	configuration, an empty value ("L=") removes one. It can use the same variables as the templates of the
+	configuration ({{.Name}}, {{.Class}}, {{.Profile}} and the ones given with --var).
+
+--var string
+	(optional) A variable of the subject templates, as name=value ("Team=ops" for {{.Team}}). You can provide this
+	parameter multiple times.
+
+--ou, --province, --street, --postal-code, --subject-email, --subject-serial string
+	(optional) The OrganizationalUnit, Province, StreetAddress, PostalCode, emailAddress or serialNumber of the subject.`
+}
+
+
+// Build the subject of a certificate: the fields of the configuration, then the subject template of the class, the one
+// of the profile, --subject and the other subject flags (each one replacing the attributes set by the previous ones)
+func getSubject(conf Conf, class, profileName string, profile *Profile, name string, flags *subjectFlags) (pkix.Name, error) {
+	var fields map[string][]string = map[string][]string{
+		"CN": []string{name},
+		"O": []string{conf.Organization},
+		"C": []string{conf.Country},
+		"L": []string{conf.Locality},
+	}
+
+	if profile != nil && profileName == "" {
+		profileName = getDefaultProfileName(class)
+	}
+
+	var data map[string]string = map[string]string{
+		"Name": escapeDNValue(name),
+		"Class": class,
+		"Profile": profileName,
+	}
+	for _, variable := range flags.vars {
+		var parts []string = strings.SplitN(variable, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return pkix.Name{}, errors.New("invalid variable " + variable + " (expected name=value)")
+		}
+		data[parts[0]] = escapeDNValue(parts[1])
+	}
+
+	var templates []string = []string{conf.Subjects[class]}
+	if profile != nil {
+		templates = append(templates, (*profile).Subject)
+	}
+	templates = append(templates, flags.subject)
+
+	for _, dnTemplate := range templates {
+		if dnTemplate == "" {
+			continue
+		}
+
+		dn, err := executeDNTemplate(dnTemplate, data)
+		if err != nil {
+			return pkix.Name{}, err
+		}
+
+		attributes, err := parseDN(dn)
+		if err != nil {
+			return pkix.Name{}, err
+		}
+
+		for attributeType, values := range attributes {
+			fields[attributeType] = values
+		}
+	}
+
+	for attributeType, value := range map[string]string{
+		"OU": flags.ou,
+		"ST": flags.province,
+		"STREET": flags.street,
+		"POSTALCODE": flags.postalCode,
+		"EMAILADDRESS": flags.email,
+		"SERIALNUMBER": flags.serialNumber,
+	} {
+		if value != "" {
+			fields[attributeType] = []string{value}
+		}
+	}
+
+	for attributeType, values := range fields {
+		var nonEmpty []string
+
+		for _, value := range values {
+			if value != "" {
+				nonEmpty = append(nonEmpty, value)
+			}
+		}
+
+		fields[attributeType] = nonEmpty
+	}
+
+	if len(fields["CN"]) != 1 || len(fields["SERIALNUMBER"]) > 1 {
+		return pkix.Name{}, errors.New("the subject must have one CommonName and at most one serialNumber")
+	}
+
+	var subject pkix.Name = pkix.Name{
+		CommonName: fields["CN"][0],
+		Organization: fields["O"],
+		OrganizationalUnit: fields["OU"],
+		Country: fields["C"],
+		Province: fields["ST"],
+		Locality: fields["L"],
+		StreetAddress: fields["STREET"],
+		PostalCode: fields["POSTALCODE"],
+	}
+
+	if len(fields["SERIALNUMBER"]) == 1 {
+		subject.SerialNumber = fields["SERIALNUMBER"][0]
+	}
+
+	for _, email := range fields["EMAILADDRESS"] {
+		subject.ExtraNames = append(subject.ExtraNames, pkix.AttributeTypeAndValue{Type: oidEmailAddress, Value: email})
+	}
+
+	return subject, nil
+}
+
+
+func executeDNTemplate(dnTemplate string, data map[string]string) (string, error) {
+	var dn bytes.Buffer
+
+	tmpl, err := template.New("subject").Option("missingkey=error").Parse(dnTemplate)
+	if err != nil {
+		return "", errors.New("invalid subject template " + dnTemplate + ": " + err.Error())
+	}
+
+	err = tmpl.Execute(&dn, data)
+	if err != nil {
+		return "", errors.New("can't build the subject from " + dnTemplate + " (missing --var?): " + err.Error())
+	}
+
+	return dn.String(), nil
+}
+
+
+// Parse a RFC 4514 distinguished name into its values by attribute type. Multi-valued RDNs (joined with +) are
+// handled as separate attributes.
+func parseDN(dn string) (map[string][]string, error) {
+	var attributes map[string][]string = map[string][]string{}
+	var attribute, value strings.Builder
+	var inValue bool
+
+	var addAttribute = func() error {
+		var name string = strings.TrimSpace(attribute.String())
+
+		attributeType, ok := dnAttributeTypes[strings.ToLower(name)]
+		if !ok || !inValue {
+			return errors.New("invalid subject " + dn + ": unknown or malformed attribute " + name)
+		}
+
+		attributes[attributeType] = append(attributes[attributeType], strings.TrimSpace(value.String()))
+
+		attribute.Reset()
+		value.Reset()
+		inValue = false
+
+		return nil
+	}
+
+	for i := 0; i < len(dn); i++ {
+		var c byte = dn[i]
+
+		switch {
+		case c == '\\' && i + 1 < len(dn):
+			// An escaped character, or a byte in hexadecimal
+			if decoded, err := hex.DecodeString(dn[i + 1:min(i + 3, len(dn))]); err == nil && len(decoded) == 1 {
+				value.Write(decoded)
+				i += 2
+			} else {
+				value.WriteByte(dn[i + 1])
+				i++
+			}
+		case c == '=' && !inValue:
+			inValue = true
+		case (c == ',' || c == '+') && inValue:
+			if err := addAttribute(); err != nil {
+				return nil, err
+			}
+		case inValue:
+			value.WriteByte(c)
+		default:
+			attribute.WriteByte(c)
+		}
+	}
+
+	if strings.TrimSpace(attribute.String()) != "" || inValue {
+		if err := addAttribute(); err != nil {
+			return nil, err
+		}
+	}
+
+	return attributes, nil
+}
+
+
+// Escape the special characters of a RFC 4514 attribute value
+func escapeDNValue(value string) string {
+	var escaped strings.Builder
+
+	for _, c := range value {
+		if strings.ContainsRune(",+\"\\<>;=#", c) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(c)
+	}
+
+	return escaped.String()
+}
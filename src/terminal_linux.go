@@ -0,0 +1,9 @@
+package main
+
+import (
+	"syscall"
+)
+
+
+const ioctlGetTermios = syscall.TCGETS
+const ioctlSetTermios = syscall.TCSETS
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strings"
+)
+
+
+var oidFreshestCRL asn1.ObjectIdentifier = asn1.ObjectIdentifier{2, 5, 29, 46}
+
+
+// Where relying parties find the certificate and the revocation status of a CA
+type CAURLs struct {
+	// The certificate of the CA is expected in DER at <IssuerBaseURL>/<CA name>.cer
+	IssuerBaseURL string
+	// The CRL of the CA is expected at <CRLBaseURL>/<CA name>.crl
+	CRLBaseURL string
+	// The delta CRL of the CA is expected at <DeltaCRLBaseURL>/<CA name>-delta.crl, it is then given in the Freshest CRL
+	// extension of its base CRLs and of the certificates it issues
+	DeltaCRLBaseURL string `json:",omitempty"`
+	OCSPURL string
+}
+
+
+// The URLs of the CA, or the ones given for all CAs ("*")
+func getCAURLs(conf Conf, ca string) *CAURLs {
+	if urls, ok := conf.URLs[ca]; ok {
+		return urls
+	}
+
+	return conf.URLs["*"]
+}
+
+
+// Add the Authority Information Access, CRL Distribution Points and Freshest CRL extensions of the CA to a certificate
+// it issues
+func setCAURLs(cert *x509.Certificate, conf Conf, ca string) error {
+	var urls *CAURLs = getCAURLs(conf, ca)
+	if urls == nil {
+		return nil
+	}
+
+	if (*urls).IssuerBaseURL != "" {
+		cert.IssuingCertificateURL = []string{strings.TrimSuffix((*urls).IssuerBaseURL, "/") + "/" + ca + ".cer"}
+	}
+	if (*urls).CRLBaseURL != "" {
+		cert.CRLDistributionPoints = []string{strings.TrimSuffix((*urls).CRLBaseURL, "/") + "/" + ca + ".crl"}
+	}
+	if (*urls).OCSPURL != "" {
+		cert.OCSPServer = []string{(*urls).OCSPURL}
+	}
+
+	freshestCRL, err := getFreshestCRLExtension(conf, ca)
+	if err != nil {
+		return err
+	}
+	if freshestCRL != nil {
+		cert.ExtraExtensions = append(cert.ExtraExtensions, *freshestCRL)
+	}
+
+	return nil
+}
+
+
+// The Freshest CRL extension (where the delta CRL of the CA is published), nil if the CA has no DeltaCRLBaseURL
+func getFreshestCRLExtension(conf Conf, ca string) (*pkix.Extension, error) {
+	var urls *CAURLs = getCAURLs(conf, ca)
+	if urls == nil || (*urls).DeltaCRLBaseURL == "" {
+		return nil, nil
+	}
+
+	var url string = strings.TrimSuffix((*urls).DeltaCRLBaseURL, "/") + "/" + ca + "-delta.crl"
+
+	// Same syntax as the CRL Distribution Points extension: a distribution point with the URI as full name
+	type distributionPointName struct {
+		FullName []asn1.RawValue `asn1:"optional,tag:0"`
+	}
+	type distributionPoint struct {
+		DistributionPoint distributionPointName `asn1:"optional,tag:0"`
+	}
+
+	value, err := asn1.Marshal([]distributionPoint{
+		{DistributionPoint: distributionPointName{FullName: []asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(url)}}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &pkix.Extension{Id: oidFreshestCRL, Value: value}, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"time"
+)
+
+
+// The flags overriding the validity of the configuration
+type validityFlags struct {
+	days, hours int
+	notAfter string
+}
+
+
+func (f *validityFlags) addFlags(commands *flag.FlagSet) {
+	commands.IntVar(&f.days, "days", 0, "")
+	commands.IntVar(&f.hours, "hours", 0, "")
+	commands.StringVar(&f.notAfter, "not-after", "", "")
+}
+
+
+// The help of the flags registered by addFlags
+func getHelpValidity() string {
+	return `--days int
+	(optional) How many days the certificate is valid for. Defaults to the validity of the class in the configuration.
+
+--hours int
+	(optional) How many hours the certificate is valid for.
+
+--not-after string
+	(optional) The date the certificate expires on, as 2006-01-02 (midnight UTC) or 2006-01-02T15:04:05Z07:00.`
+}
+
+
+// Return the validity period of a certificate of the class, and whether it has been explicitly given
+func (f *validityFlags) get(conf Conf, class string) (notBefore, notAfter time.Time, explicit bool, err error) {
+	var now time.Time = time.Now()
+
+	notBefore = now
+	if conf.Backdate != "" {
+		backdate, err := time.ParseDuration(conf.Backdate)
+		if err != nil || backdate < 0 {
+			return notBefore, notAfter, false, errors.New("invalid Backdate " + conf.Backdate + " in the configuration (e.g. 5m or 1h)")
+		}
+		notBefore = now.Add(-backdate)
+	}
+
+	var given int
+	for _, set := range []bool{f.days != 0, f.hours != 0, f.notAfter != ""} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		return notBefore, notAfter, false, errors.New("only one of --days, --hours and --not-after can be given")
+	}
+
+	switch {
+	case f.days < 0 || f.hours < 0:
+		return notBefore, notAfter, false, errors.New("the validity must be positive")
+	case f.days > 0:
+		return notBefore, now.AddDate(0, 0, f.days), true, nil
+	case f.hours > 0:
+		return notBefore, now.Add(time.Duration(f.hours) * time.Hour), true, nil
+	case f.notAfter != "":
+		notAfter, err = time.Parse("2006-01-02", f.notAfter)
+		if err != nil {
+			notAfter, err = time.Parse(time.RFC3339, f.notAfter)
+		}
+		if err != nil {
+			return notBefore, notAfter, false, errors.New(f.notAfter + " is not a valid date (2006-01-02 or 2006-01-02T15:04:05Z07:00)")
+		}
+		if !notAfter.After(now) {
+			return notBefore, notAfter, false, errors.New("the date given with --not-after is in the past")
+		}
+		return notBefore, notAfter, true, nil
+	}
+
+	notAfter, err = getDefaultNotAfter(conf, class, now)
+
+	return notBefore, notAfter, false, err
+}
+
+
+// The validity of the class in the configuration, or CertificateDuration for configurations of older simpleca versions
+func getDefaultNotAfter(conf Conf, class string, now time.Time) (time.Time, error) {
+	validity, ok := conf.Validity[class]
+	if !ok {
+		if conf.CertificateDuration <= 0 {
+			return now, errors.New("no validity for " + class + " in the configuration, add it to Validity or give one with --days, --hours or --not-after")
+		}
+		return now.AddDate(0, conf.CertificateDuration, 0), nil
+	}
+
+	notAfter, err := addValidity(now, validity)
+	if err != nil {
+		return now, errors.New("invalid validity " + validity + " for " + class + " in the configuration (e.g. 20y, 6m, 90d or 12h)")
+	}
+
+	return notAfter, nil
+}
+
+
+// Add a validity given as a number followed by y (years), m (months), d (days) or h (hours) to the date
+func addValidity(now time.Time, validity string) (time.Time, error) {
+	var invalid error = errors.New("invalid validity " + validity + " (e.g. 20y, 6m, 90d or 12h)")
+
+	if len(validity) < 2 {
+		return now, invalid
+	}
+
+	count, err := strconv.Atoi(validity[:len(validity) - 1])
+	if err != nil || count <= 0 {
+		return now, invalid
+	}
+
+	switch validity[len(validity) - 1] {
+	case 'y':
+		return now.AddDate(count, 0, 0), nil
+	case 'm':
+		return now.AddDate(0, count, 0), nil
+	case 'd':
+		return now.AddDate(0, 0, count), nil
+	case 'h':
+		return now.Add(time.Duration(count) * time.Hour), nil
+	default:
+		return now, invalid
+	}
+}
+
+
+// A certificate can't outlive its issuer: the default validity is shortened, an explicit one is refused
+func capNotAfter(notAfter time.Time, explicit bool, issuer string, issuerNotAfter time.Time) (time.Time, string, error) {
+	if !notAfter.After(issuerNotAfter) {
+		return notAfter, "", nil
+	}
+
+	if explicit {
+		return notAfter, "", errors.New("the certificate would expire after its issuer " + issuer + " (" + issuerNotAfter.UTC().Format(time.RFC3339) + ")")
+	}
+
+	return issuerNotAfter, "The validity has been shortened to the one of " + issuer + ", the certificate expires on " + issuerNotAfter.UTC().Format(time.RFC3339), nil
+}